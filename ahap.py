@@ -1,9 +1,32 @@
 from enum import Enum
+import array
+import bisect
+import copy
 import datetime
+import difflib
 import math
 import os
+import csv
 import json
-from typing import Any, List, Tuple
+import plistlib
+import random
+import sys
+import uuid
+import warnings
+import wave
+from typing import IO, Any, Callable, List, Tuple
+
+_clock = datetime.datetime.now
+
+def set_clock(clock: Callable[[], datetime.datetime] = datetime.datetime.now):
+    """
+    Sets the function that gives the creation time of new AHAP objects, for example a fixed time for reproducible output.
+
+    Args:
+        clock (Callable[[], datetime.datetime]): The clock. Call set_clock() without arguments to go back to the current time.
+    """
+    global _clock
+    _clock = clock
 
 class HapticCurve:
     """Represents the haptic curve"""
@@ -46,6 +69,10 @@ def curves(c: List[HapticCurve]) -> List[dict]:
     return [i.get_data() for i in c]
 
 class CurveParamID(Enum):
+    """
+    Control parameters, used by curves and dynamic parameters. They don't belong to an event:
+    they scale (intensity, volume) or offset (the others) every event that plays while they're active.
+    """
     H_Intensity = "HapticIntensityControl"
     H_Sharpness = "HapticSharpnessControl"
     H_AttackTime = "HapticAttackTimeControl"
@@ -60,6 +87,7 @@ class CurveParamID(Enum):
     A_ReleaseTime = "AudioReleaseTimeControl"
 
 class ParamID(Enum):
+    """Event parameters, set per event in EventParameters. They only affect the event they belong to."""
     H_Intensity = "HapticIntensity"
     H_Sharpness = "HapticSharpness"
     H_AttackTime = "HapticAttackTime"
@@ -73,6 +101,70 @@ class ParamID(Enum):
     A_DecayTime = "AudioDecayTime"
     A_ReleaseTime = "AudioReleaseTime"
 
+class Preset(Enum):
+    Heartbeat = "heartbeat"
+    Click = "click"
+    Tick = "tick"
+    DoubleTap = "double tap"
+    Rumble = "rumble"
+    Buzz = "buzz"
+
+# the events of every preset, relative to its start time.
+# Transients are ("HapticTransient", time, intensity, sharpness),
+# continuous events are ("HapticContinuous", time, intensity, sharpness, duration).
+PRESETS = {
+    Preset.Heartbeat: [("HapticTransient", 0.0, 1.0, 0.3), ("HapticTransient", 0.15, 0.7, 0.2)],
+    Preset.Click: [("HapticTransient", 0.0, 0.8, 0.9)],
+    Preset.Tick: [("HapticTransient", 0.0, 0.4, 1.0)],
+    Preset.DoubleTap: [("HapticTransient", 0.0, 0.9, 0.6), ("HapticTransient", 0.1, 0.9, 0.6)],
+    Preset.Rumble: [("HapticContinuous", 0.0, 0.8, 0.1, 0.6)],
+    Preset.Buzz: [("HapticContinuous", 0.0, 0.6, 0.8, 0.3)],
+}
+
+# parameters whose legal range isn't 0..1. Everything else (intensity, sharpness, volume, brightness, the envelope times) is 0..1.
+_PARAMETER_RANGES = {
+    ParamID.A_Pan.value: (-1.0, 1.0),
+    ParamID.A_Pitch.value: (-1.0, 1.0),
+    CurveParamID.H_Sharpness.value: (-1.0, 1.0),
+    CurveParamID.H_AttackTime.value: (-1.0, 1.0),
+    CurveParamID.H_DecayTime.value: (-1.0, 1.0),
+    CurveParamID.H_ReleaseTime.value: (-1.0, 1.0),
+    CurveParamID.A_Brightness.value: (-1.0, 1.0),
+    CurveParamID.A_Pan.value: (-1.0, 1.0),
+    CurveParamID.A_Pitch.value: (-1.0, 1.0),
+    CurveParamID.A_AttackTime.value: (-1.0, 1.0),
+    CurveParamID.A_DecayTime.value: (-1.0, 1.0),
+    CurveParamID.A_ReleaseTime.value: (-1.0, 1.0),
+}
+
+def parameter_range(parameter_id) -> Tuple[float, float]:
+    """
+    Get the legal value range of a parameter.
+
+    Args:
+        parameter_id (ParamID, CurveParamID or str): The event parameter or curve parameter.
+
+    Returns:
+        Tuple[float, float]: The minimum and maximum value.
+    """
+    if isinstance(parameter_id, Enum):
+        parameter_id = parameter_id.value
+    return _PARAMETER_RANGES.get(parameter_id, (0.0, 1.0))
+
+def clamp_parameter(parameter_id, value: float) -> float:
+    """
+    Clamp a value into the legal range of a parameter, see parameter_range.
+
+    Args:
+        parameter_id (ParamID, CurveParamID or str): The event parameter or curve parameter.
+        value (float): The value to clamp.
+
+    Returns:
+        float: The clamped value.
+    """
+    low, high = parameter_range(parameter_id)
+    return min(max(value, low), high)
+
 # soon we will do it a @classmethod, but it'll break compatibility so i'm lazy!
 def create_curve(start_time: float, end_time: float, start_value: float, end_value: float, total=10):
     timediff=end_time-start_time
@@ -85,27 +177,405 @@ def create_curve(start_time: float, end_time: float, start_value: float, end_val
     #print("start time", start_time, "endtime", end_time)
     return curvelist
 
+def ramp_curve(duration: float, start_value: float, end_value: float, steps: int = 10) -> List[HapticCurve]:
+    """
+    Create a linear curve with control points relative to the curve start.
+    Unlike create_curve, the first point is at time 0 and the last one is exactly at duration.
+
+    Args:
+        duration (float): The length of the curve in seconds.
+        start_value (float): The parameter value at time 0.
+        end_value (float): The parameter value at the end of the curve.
+        steps (int): The number of control points, at least 2.
+
+    Returns:
+        List[HapticCurve]: The control points of the curve.
+    """
+    if steps < 2:
+        raise ValueError(f"A ramp needs at least 2 steps, but got {steps}")
+    return [HapticCurve(duration*i/(steps-1), start_value+(end_value-start_value)*i/(steps-1)) for i in range(steps)]
+
+def log_ramp_curve(duration: float, start_value: float, end_value: float, steps: int = 10) -> List[HapticCurve]:
+    """
+    Create a logarithmic curve with control points relative to the curve start, like ramp_curve.
+    The value changes fast at first and slows down towards the end, which feels more even than a linear intensity ramp.
+
+    Args:
+        duration (float): The length of the curve in seconds.
+        start_value (float): The parameter value at time 0.
+        end_value (float): The parameter value at the end of the curve.
+        steps (int): The number of control points, at least 2.
+
+    Returns:
+        List[HapticCurve]: The control points of the curve.
+    """
+    if steps < 2:
+        raise ValueError(f"A ramp needs at least 2 steps, but got {steps}")
+    return [HapticCurve(duration*i/(steps-1), start_value+(end_value-start_value)*math.log10(1+9*i/(steps-1))) for i in range(steps)]
+
+def _douglas_peucker(points: List[Tuple[float, float]], tolerance: float) -> List[Tuple[float, float]]:
+    """Ramer-Douglas-Peucker on (time, value) pairs, measuring the error in value at each point's time."""
+    if len(points) < 3:
+        return list(points)
+    (t0, v0), (t1, v1) = points[0], points[-1]
+    worst, index = -1.0, 0
+    for i in range(1, len(points)-1):
+        t, v = points[i]
+        expected = v0 if t1 == t0 else v0+(v1-v0)*(t-t0)/(t1-t0)
+        if abs(v-expected) > worst:
+            worst, index = abs(v-expected), i
+    if worst <= tolerance:
+        return [points[0], points[-1]]
+    return _douglas_peucker(points[:index+1], tolerance)[:-1]+_douglas_peucker(points[index:], tolerance)
+
+def simplify_curve(control_points: List[HapticCurve], tolerance: float) -> List[HapticCurve]:
+    """
+    Removes control points that are not needed to keep the shape of a curve, with the Ramer-Douglas-Peucker algorithm.
+    Useful for dense generated curves, for example a straight line of 50 points becomes 2.
+
+    Args:
+        control_points (List[HapticCurve]): The control points, sorted by time.
+        tolerance (float): How far the simplified curve may be from any removed point, in parameter units.
+
+    Returns:
+        List[HapticCurve]: The remaining control points.
+    """
+    return [HapticCurve(t, v) for t, v in _douglas_peucker([(p.time, p.parameter_value) for p in control_points], tolerance)]
+
+def event_parameter(event: dict, parameter_id, default: float = None) -> float:
+    """
+    Get the value of a parameter of an event from the pattern.
+
+    Args:
+        event (dict): The "Event" dictionary of a pattern entry.
+        parameter_id (ParamID or str): The parameter to look up.
+        default (float): The value to return when the event doesn't have the parameter.
+
+    Returns:
+        float: The parameter value.
+    """
+    if isinstance(parameter_id, Enum):
+        parameter_id = parameter_id.value
+    return next((p["ParameterValue"] for p in event["EventParameters"] if p["ParameterID"] == parameter_id), default)
+
+def curve_from_func(start_time: float, end_time: float, steps: int, f: Callable[[float], float], parameter_id=CurveParamID.H_Intensity) -> List[HapticCurve]:
+    """
+    Create a curve by sampling a function.
+
+    Args:
+        start_time (float): The time of the first control point.
+        end_time (float): The time of the last control point.
+        steps (int): The number of control points, at least 2.
+        f (Callable[[float], float]): The function to sample. It gets t from 0 to 1 and returns the parameter value.
+        parameter_id (CurveParamID or str): The parameter the curve is for. Values are clamped to its range.
+
+    Returns:
+        List[HapticCurve]: The control points of the curve.
+    """
+    if steps < 2:
+        raise ValueError(f"A curve needs at least 2 steps, but got {steps}")
+    points = []
+    for i in range(steps):
+        t = i/(steps-1)
+        points.append(HapticCurve(start_time+(end_time-start_time)*t, clamp_parameter(parameter_id, f(t))))
+    return points
+
+# easing functions for keyframe_curve: they map the progress through a segment, from 0 to 1, to the progress of the value.
+INTERPOLATIONS = {
+    "linear": lambda t: t,
+    "ease": lambda t: t*t*(3-2*t),
+}
+
+def keyframe_curve(keys: List[Tuple[float, float]], interpolation: str = "linear", steps: int = 10) -> List[HapticCurve]:
+    """
+    Create a curve through several keyframes, interpolating each segment between two neighbouring keys.
+
+    Args:
+        keys (List[Tuple[float, float]]): At least 2 (time, value) keys with increasing times, relative to the curve start.
+        interpolation (str): The easing of every segment, one of INTERPOLATIONS.
+        steps (int): The number of control points per segment, counting both keys, at least 2.
+
+    Returns:
+        List[HapticCurve]: The control points of the curve. Neighbouring segments share their key.
+
+    Raises:
+        ValueError: If there are less than 2 keys, their times don't increase, the interpolation is unknown or steps is less than 2.
+    """
+    if len(keys) < 2:
+        raise ValueError(f"A keyframe curve needs at least 2 keys, but got {len(keys)}")
+    if any(t1 <= t0 for (t0, v0), (t1, v1) in zip(keys, keys[1:])):
+        raise ValueError("The times of the keys must increase")
+    if interpolation not in INTERPOLATIONS:
+        raise ValueError(f"Unknown interpolation {interpolation}. Known interpolations are: {', '.join(INTERPOLATIONS)}")
+    if steps < 2:
+        raise ValueError(f"A curve needs at least 2 steps, but got {steps}")
+    ease = INTERPOLATIONS[interpolation]
+    points = [HapticCurve(*keys[0])]
+    for (t0, v0), (t1, v1) in zip(keys, keys[1:]):
+        for i in range(1, steps):
+            x = i/(steps-1)
+            points.append(HapticCurve(t0+(t1-t0)*x, v0+(v1-v0)*ease(x)))
+    return points
+
+def pattern_span(entry: dict) -> Tuple[float, float]:
+    """
+    Get the start and end time of a pattern entry.
+    Transients and dynamic parameters are points, continuous events end after their duration
+    and curves end at their last control point.
+
+    Args:
+        entry (dict): An entry of the pattern, e.g. {"Event": {...}}.
+
+    Returns:
+        Tuple[float, float]: The start and end time in seconds.
+    """
+    if "Event" in entry:
+        return entry["Event"]["Time"], entry["Event"]["Time"]+entry["Event"].get("EventDuration", 0.0)
+    if "ParameterCurve" in entry:
+        curve = entry["ParameterCurve"]
+        return curve["Time"], max([curve["Time"]]+[curve["Time"]+point["Time"] for point in curve["ParameterCurveControlPoints"]])
+    time = next(iter(entry.values()))["Time"]
+    return time, time
+
+# the key that holds the channel set with AHAP.set_channel inside an event or curve. It's removed on export.
+_CHANNEL_KEY = "_Channel"
+
+def _channel(entry: dict) -> int:
+    return next(iter(entry.values())).get(_CHANNEL_KEY, 0)
+
+def _set_channel(entry: dict, channel: int):
+    value = next(iter(entry.values()))
+    if channel:
+        value[_CHANNEL_KEY] = channel
+    else:
+        value.pop(_CHANNEL_KEY, None)
+
+def _untagged(entry: dict) -> dict:
+    kind, value = next(iter(entry.items()))
+    if _CHANNEL_KEY not in value:
+        return entry
+    return {kind: {k: v for k, v in value.items() if k != _CHANNEL_KEY}}
+
+def _move_markers(metadata: dict, start: float, end: float):
+    # Comments outside the range are dropped and the loop is clipped to it, or dropped if it doesn't overlap
+    if "Comments" in metadata:
+        metadata["Comments"] = [dict(c, Time=c["Time"]-start) for c in metadata["Comments"] if start <= c["Time"] < end]
+    if "LoopStart" in metadata and "LoopEnd" in metadata:
+        loop_start, loop_end = max(metadata["LoopStart"], start), min(metadata["LoopEnd"], end)
+        if loop_end > loop_start:
+            metadata["LoopStart"], metadata["LoopEnd"] = loop_start-start, loop_end-start
+        else:
+            del metadata["LoopStart"], metadata["LoopEnd"]
+
+# the length of a continuous event that costs as much energy as one transient, see AHAP.energy_estimate.
+TRANSIENT_ENERGY = 0.01
+
+# the length of a transient in AHAP.export_preview_wav, in seconds.
+CLICK_LENGTH = 0.02
+
+# metadata keys renamed by AHAP.export(legacy_keys=True).
+LEGACY_KEYS = {"Created By": "CreatedBy"}
+
+# AHAP format versions this module knows how to read and write.
+SUPPORTED_VERSIONS = (1.0,)
+
+# columns written by AHAP.export_csv, in this order.
+CSV_COLUMNS = ["time", "type", "intensity", "sharpness", "duration", "curve_id", "parameter", "value"]
+
 
 class AHAP:
     """_Class that allows to make Apple haptic signal files (.ahap)."""
-    def __init__(self, description: str = "test AHAP file", created_by: str = "Deniz Sincar"):
+    def __init__(self, description: str = "test AHAP file", created_by: str = "Deniz Sincar", created: datetime.datetime = None,
+                 project: str = "Basis", version: float = 1.0):
         """
         Initialize an AHAP object.
 
         Args:
             description (str): The description of the AHAP file.
             created_by (str): The creator of the AHAP file.
+            created (datetime.datetime): The creation time written to the metadata. Defaults to the time of the clock, see set_clock.
+            project (str): The project name in the metadata.
+            version (float): The AHAP format version.
         """
         self.data = {
-            "Version": 1.0,
+            "Version": version,
             "Metadata": {
-                "Project": "Basis",
-                "Created": str(datetime.datetime.now()),
+                "Project": project,
+                "Created": str(created if created is not None else _clock()),
                 "Description": description,
                 "Created By": created_by
             },
             "Pattern": []
         }
+        self.time_offset = 0.0
+        self.default_intensity = 0.5
+        self.default_sharpness = 0.5
+        self.until_next = []
+        self.channel = 0
+        self.continuous_envelope = None
+        self.curve_tolerance = None
+        self.tracks = {}
+
+    @classmethod
+    def load(cls, filename: str, path: str = ".") -> 'AHAP':
+        """
+        Load an AHAP file. The version of the file is kept as it is, files of a version not in SUPPORTED_VERSIONS load with a warning,
+        as their fields may mean something else.
+
+        Args:
+            filename (str): The name of the file.
+            path (str): The path to the directory of the file.
+
+        Returns:
+            AHAP: The loaded AHAP object.
+        """
+        ahap = cls()
+        with open(os.path.join(path, filename)) as f:
+            ahap.data = json.load(f)
+        if not ahap.supported_version():
+            warnings.warn(f"{filename} has AHAP version {ahap.data.get('Version')}, only version {', '.join(f'{v:g}' for v in SUPPORTED_VERSIONS)} is supported.")
+        return ahap
+
+    @classmethod
+    def from_csv(cls, f: IO[str], description: str = "test AHAP file", created_by: str = "Deniz Sincar") -> 'AHAP':
+        """
+        Create an AHAP object from a CSV table of haptic events.
+        The first row is a header. The time and type columns are required, intensity, sharpness and duration are optional
+        and fall back to the defaults of add_haptic_transient_event and add_haptic_continuous_event. Unknown columns are ignored.
+        The type column holds "transient" or "continuous" (or the full HapticTransient / HapticContinuous names).
+        The ParameterCurve, AudioContinuous and AudioCustom rows written by export_csv are skipped, only haptic events are read.
+
+        Args:
+            f (IO[str]): An open text file or any other iterable of CSV lines.
+            description (str): The description of the AHAP file.
+            created_by (str): The creator of the AHAP file.
+
+        Returns:
+            AHAP: The new AHAP object.
+
+        Raises:
+            ValueError: If a required column is missing or a row can't be parsed. The message contains the line number.
+        """
+        ahap = cls(description, created_by)
+        reader = csv.DictReader(f)
+        missing = {"time", "type"} - {name.strip().lower() for name in reader.fieldnames or []}
+        if missing:
+            raise ValueError(f"CSV is missing required columns: {', '.join(sorted(missing))}")
+        for row in reader:
+            row = {k.strip().lower(): v.strip() for k, v in row.items() if k is not None and v is not None and v.strip() != ""}
+            try:
+                time = float(row["time"])
+                kwargs = {}
+                if "intensity" in row:
+                    kwargs["haptic_intensity"] = float(row["intensity"])
+                if "sharpness" in row:
+                    kwargs["haptic_sharpness"] = float(row["sharpness"])
+                etype = row["type"].lower()
+                if etype in ("parametercurve", "audiocontinuous", "audiocustom"):
+                    continue
+                if etype in ("transient", "haptictransient"):
+                    ahap.add_haptic_transient_event(time, **kwargs)
+                elif etype in ("continuous", "hapticcontinuous"):
+                    if "duration" in row:
+                        kwargs["event_duration"] = float(row["duration"])
+                    ahap.add_haptic_continuous_event(time, **kwargs)
+                else:
+                    raise ValueError(f"unknown event type {row['type']}")
+            except (KeyError, ValueError) as e:
+                raise ValueError(f"CSV line {reader.line_num}: {e}") from e
+        return ahap
+
+    def set_defaults(self, intensity: float = 0.5, sharpness: float = 0.5):
+        """
+        Sets the intensity and sharpness used by haptic events added from now on when they don't get their own.
+        Events already in the pattern are not changed.
+
+        Args:
+            intensity (float): The default intensity, 0.5 unless changed.
+            sharpness (float): The default sharpness, 0.5 unless changed.
+        """
+        self.default_intensity = intensity
+        self.default_sharpness = sharpness
+
+    def set_continuous_envelope(self, attack: float, release: float):
+        """
+        Gives every haptic continuous event added from now on an attack and release time, so they don't start and stop with a click.
+        Call clear_continuous_envelope to stop adding them.
+
+        Args:
+            attack (float): The HapticAttackTime parameter, between 0 and 1.
+            release (float): The HapticReleaseTime parameter, between 0 and 1.
+        """
+        self.continuous_envelope = (attack, release)
+
+    def clear_continuous_envelope(self):
+        """Stops adding the envelope set with set_continuous_envelope."""
+        self.continuous_envelope = None
+
+    def set_time_offset(self, seconds: float):
+        """
+        Shifts every event, curve, comment and loop added from now on by the given number of seconds.
+        Set it back to 0 to add content at absolute times again. Events already in the pattern are not moved.
+
+        Args:
+            seconds (float): The offset in seconds.
+        """
+        self.time_offset = seconds
+
+    def set_curve_tolerance(self, tolerance: float = None):
+        """
+        Simplifies every curve added from now on, see simplify_curve. This includes the curves that helpers like add_curve_for,
+        fade_in and auto_release add. Curves already in the pattern are not changed.
+
+        Args:
+            tolerance (float): How far the simplified curves may be from any removed point, in parameter units. None to stop simplifying.
+        """
+        self.curve_tolerance = tolerance
+
+    def group(self, at: float, fn: Callable[['AHAP'], Any]):
+        """
+        Calls fn with this AHAP, and everything fn adds is placed relative to the given time.
+        Use it to stamp a motif authored from time 0 at any position. Groups can be nested.
+
+        Args:
+            at (float): The time the group starts at, in seconds.
+            fn (Callable[[AHAP], Any]): Adds the events of the group.
+        """
+        offset = self.time_offset
+        self.time_offset += at
+        try:
+            fn(self)
+        finally:
+            self.time_offset = offset
+
+    def set_channel(self, channel: int):
+        """
+        Tags everything added from now on with an actuator channel, for devices with more than one actuator.
+        AHAP itself is mono, so the tags are not part of the file. Use export_by_channel to write one file per channel.
+
+        Args:
+            channel (int): The channel, 0 unless changed.
+        """
+        self.channel = channel
+
+    def _add_to_pattern(self, entry: dict):
+        _set_channel(entry, self.channel)
+        self.data["Pattern"].append(entry)
+
+    def repeat_with_variation(self, count: int, spacing: float, fn: Callable[['AHAP', int, random.Random], Any], seed: int = None):
+        """
+        Repeats a motif count times, spacing seconds apart. fn gets the repetition number and a seeded random generator,
+        so it can vary the motif, for example add a fill on every 4th repetition. Like in group, fn adds events from time 0.
+
+        Args:
+            count (int): The number of repetitions.
+            spacing (float): The time between the starts of two repetitions, in seconds.
+            fn (Callable[[AHAP, int, random.Random], Any]): Adds one repetition. Gets this AHAP, the repetition number from 0 and the random generator.
+            seed (int): The seed of the random generator, for the same variations every time.
+        """
+        rng = random.Random(seed)
+        for rep in range(count):
+            self.group(rep*spacing, lambda a: fn(a, rep, rng))
 
     def add_event(self, etype: str, time: float, parameters: List[dict], event_duration: float = None, event_waveform_path: str = None):
         """
@@ -119,7 +589,7 @@ class AHAP:
         """
         pattern = {
             "Event": {
-                "Time": time,
+                "Time": time+self.time_offset,
                 "EventType": etype,
                 "EventParameters": parameters
             }
@@ -128,22 +598,112 @@ class AHAP:
             pattern["Event"]["EventDuration"] = event_duration
         if event_waveform_path is not None:
             pattern["Event"]["EventWaveformPath"] = event_waveform_path
-        self.data["Pattern"].append(pattern)
+        for event in [e for e in self.until_next if e["Time"] < pattern["Event"]["Time"]]:
+            event["EventDuration"] = pattern["Event"]["Time"]-event["Time"]
+            self.until_next.remove(event)
+        self._add_to_pattern(pattern)
+
+    def add_comment(self, time: float, text: str):
+        """
+        Adds a named marker to the file. AHAP has no marker event, so comments are kept in a "Comments" list in the metadata,
+        which Core Haptics doesn't read.
+
+        Args:
+            time (float): The time the comment refers to, in seconds.
+            text (str): The comment.
+        """
+        self.data["Metadata"].setdefault("Comments", []).append({"Time": time+self.time_offset, "Text": text})
+
+    def set_loop(self, start: float, end: float):
+        """
+        Marks the part of the pattern a game should loop, for ambient haptics. AHAP has no loops, so the markers are kept
+        as "LoopStart" and "LoopEnd" in the metadata, for the player to read. Core Haptics ignores them.
+
+        Args:
+            start (float): The start of the loop in seconds.
+            end (float): The end of the loop in seconds.
+
+        Raises:
+            ValueError: If start is negative or end is not after start.
+        """
+        start, end = start+self.time_offset, end+self.time_offset
+        if start < 0 or end <= start:
+            raise ValueError(f"Incorrect loop from {start} to {end}. The loop must start at 0 or later and end after its start.")
+        self.data["Metadata"]["LoopStart"] = start
+        self.data["Metadata"]["LoopEnd"] = end
+
+    def loop(self) -> Tuple[float, float]:
+        """
+        Get the loop markers set with set_loop.
+
+        Returns:
+            Tuple[float, float]: The start and end of the loop in seconds, or None if there is no loop.
+        """
+        if "LoopStart" not in self.data["Metadata"] or "LoopEnd" not in self.data["Metadata"]:
+            return None
+        return self.data["Metadata"]["LoopStart"], self.data["Metadata"]["LoopEnd"]
+
+    def insert(self, time: float, motif: 'AHAP'):
+        """
+        Adds a copy of the pattern of another AHAP, for example one from load_library, starting at the given time.
+
+        Args:
+            time (float): The time the motif starts at, in seconds.
+            motif (AHAP): The AHAP to insert. It is not modified.
+        """
+        self.group(time, lambda a: a.add_events(*motif.data["Pattern"]))
+
+    def add_events(self, *entries: dict):
+        """
+        Adds pre-built pattern entries, like the ones returned by grain_cloud, in the given order.
+        The entries are copied with all their keys and shifted by the time offset like any other added event.
+        Curves are simplified with the curve tolerance like any other added curve.
+
+        Args:
+            *entries (dict): Pattern entries such as {"Event": {...}}, {"ParameterCurve": {...}} or {"Parameter": {...}}.
+        """
+        for entry in copy.deepcopy(entries):
+            if "Event" in entry:
+                event = entry["Event"]
+                self.add_event(event["EventType"], event["Time"], event["EventParameters"], event.get("EventDuration"), event.get("EventWaveformPath"))
+                added = self.data["Pattern"][-1]["Event"]
+                for key, value in event.items():
+                    if key != _CHANNEL_KEY:
+                        added.setdefault(key, value)
+            elif "ParameterCurve" in entry:
+                curve = entry["ParameterCurve"]
+                points = [HapticCurve(point["Time"], point["ParameterValue"]) for point in curve["ParameterCurveControlPoints"]]
+                self._add_curve(CurveParamID(curve["ParameterID"]), curve["Time"]+self.time_offset, points)
+                added = self.data["Pattern"][-1]["ParameterCurve"]
+                for key, value in curve.items():
+                    if key != _CHANNEL_KEY:
+                        added.setdefault(key, value)
+            else:
+                next(iter(entry.values()))["Time"] += self.time_offset
+                self._add_to_pattern(entry)
 
     def __rshift__(self, args: Tuple):
         self.add_event(*args)
 
-    def add_haptic_transient_event(self, time: float, haptic_intensity: float = 0.5, haptic_sharpness: float = 0.5):
+    def add_haptic_transient_event(self, time: float, haptic_intensity: float = None, haptic_sharpness: float = None, frequency: float = None, normalize: bool = True):
         """
         Adds a haptic transient event to the pattern.
 
         Args:
             time (float): The time of the event in seconds.
             haptic_intensity (float): The intensity of the haptic event.
-                Should be a float between 0 and 1.
+                Should be a float between 0 and 1. Defaults to the value set with set_defaults.
             haptic_sharpness (float): The sharpness of the haptic event.
-                Should be a float between 0 and 1.
+                Should be a float between 0 and 1. Defaults to the value set with set_defaults.
+            frequency (float): The frequency in hz to get the sharpness from with freq(), instead of haptic_sharpness.
+            normalize (bool): Clamp frequencies out of the 80-230 hz band instead of raising ValueError.
         """
+        if haptic_intensity is None:
+            haptic_intensity = self.default_intensity
+        if frequency is not None:
+            haptic_sharpness = freq(frequency, normalize)
+        if haptic_sharpness is None:
+            haptic_sharpness = self.default_sharpness
         parameters = [
             {
                 "ParameterID": ParamID.H_Intensity.value,
@@ -157,7 +717,36 @@ class AHAP:
 
         self.add_event(etype="HapticTransient", time=time, parameters=parameters)
 
-    def add_haptic_continuous_event(self, time: float, event_duration: float = 1, haptic_intensity: float = 0.5, haptic_sharpness: float = 0.5):
+    def add_transient_like(self, time: float):
+        """
+        Adds a haptic transient event with the intensity and sharpness of the most recently added haptic event.
+        If there is none yet, the defaults set with set_defaults are used.
+
+        Args:
+            time (float): The time of the event in seconds.
+        """
+        last = next((p["Event"] for p in reversed(self.data["Pattern"]) if "Event" in p and p["Event"]["EventType"].startswith("Haptic")), None)
+        if last is None:
+            self.add_haptic_transient_event(time)
+        else:
+            self.add_haptic_transient_event(time, event_parameter(last, ParamID.H_Intensity), event_parameter(last, ParamID.H_Sharpness))
+
+    def add_haptic_transients(self, start: float, spacing: float, count: int, haptic_intensity: float = None, haptic_sharpness: float = None):
+        """
+        Adds evenly spaced haptic transient events.
+
+        Args:
+            start (float): The time of the first event in seconds.
+            spacing (float): The time between two events in seconds.
+            count (int): The number of events.
+            haptic_intensity (float): The intensity of the events.
+            haptic_sharpness (float): The sharpness of the events.
+        """
+        for i in range(count):
+            self.add_haptic_transient_event(start+i*spacing, haptic_intensity, haptic_sharpness)
+
+    def add_haptic_continuous_event(self, time: float, event_duration: float = 1, haptic_intensity: float = None, haptic_sharpness: float = None,
+                                    frequency: float = None, normalize: bool = True):
         """
         Adds a haptic continuous event to the pattern.
 
@@ -165,10 +754,18 @@ class AHAP:
             time (float): The time of the event in seconds.
             event_duration (float): The duration of the haptic event in seconds.
             haptic_intensity (float): The intensity of the haptic event.
-                Should be a float between 0 and 1.
+                Should be a float between 0 and 1. Defaults to the value set with set_defaults.
             haptic_sharpness (float): The sharpness of the haptic event.
-                Should be a float between 0 and 1.
+                Should be a float between 0 and 1. Defaults to the value set with set_defaults.
+            frequency (float): The frequency in hz to get the sharpness from with freq(), instead of haptic_sharpness.
+            normalize (bool): Clamp frequencies out of the 80-230 hz band instead of raising ValueError.
         """
+        if haptic_intensity is None:
+            haptic_intensity = self.default_intensity
+        if frequency is not None:
+            haptic_sharpness = freq(frequency, normalize)
+        if haptic_sharpness is None:
+            haptic_sharpness = self.default_sharpness
         parameters = [
             {
                 "ParameterID": ParamID.H_Intensity.value,
@@ -179,10 +776,61 @@ class AHAP:
                 "ParameterValue": haptic_sharpness,
             }
         ]
+        if self.continuous_envelope is not None:
+            attack, release = self.continuous_envelope
+            parameters.append({"ParameterID": ParamID.H_AttackTime.value, "ParameterValue": attack})
+            parameters.append({"ParameterID": ParamID.H_ReleaseTime.value, "ParameterValue": release})
 
         self.add_event(etype="HapticContinuous", time=time, parameters=parameters, event_duration=event_duration)
 
-    def add_audio_custom_event(self, time: float, wav_filepath: str, volume: float = 0.75):
+    def add_continuous_until_next(self, time: float, haptic_intensity: float = None, haptic_sharpness: float = None):
+        """
+        Adds a haptic continuous event that lasts until the next event added after it, for example a pad under a rhythm.
+        Its duration is filled in when a later event is added. If none is, it lasts until the end of the pattern when exporting,
+        or 1 second if nothing else comes after it.
+
+        Args:
+            time (float): The time of the event in seconds.
+            haptic_intensity (float): The intensity of the haptic event.
+            haptic_sharpness (float): The sharpness of the haptic event.
+        """
+        self.add_haptic_continuous_event(time, 1, haptic_intensity, haptic_sharpness)
+        self.until_next.append(self.data["Pattern"][-1]["Event"])
+
+    def _close_until_next(self):
+        for event in self.until_next:
+            end = self.duration()
+            if end > event["Time"]+event["EventDuration"]:
+                event["EventDuration"] = end-event["Time"]
+        self.until_next = []
+        for track in self.tracks.values():
+            track._close_until_next()
+
+    def add_audio_continuous_event(self, time: float, event_duration: float = 1, volume: float = 0.75, pitch: float = None, pan: float = None, brightness: float = None):
+        """
+        Adds an audio continuous event, a tone generated by Core Haptics, to the pattern.
+
+        Args:
+            time (float): The time of the event in seconds.
+            event_duration (float): The duration of the event in seconds.
+            volume (float): The volume of the audio event, between 0 and 1.
+            pitch (float): Optional pitch of the audio event, between -1 and 1.
+            pan (float): Optional stereo pan of the audio event, between -1 (left) and 1 (right).
+            brightness (float): Optional brightness of the audio event, between 0 and 1.
+        """
+        parameters = [
+            {
+                "ParameterID": ParamID.A_Volume.value,
+                "ParameterValue": volume,
+            }
+        ]
+        for param, value in ((ParamID.A_Pitch, pitch), (ParamID.A_Pan, pan), (ParamID.A_Brightness, brightness)):
+            if value is not None:
+                parameters.append({"ParameterID": param.value, "ParameterValue": value})
+        self.add_event(etype="AudioContinuous", time=time, parameters=parameters, event_duration=event_duration)
+
+    def add_audio_custom_event(self, time: float, wav_filepath: str, volume: float = 0.75, pitch: float = None, pan: float = None, brightness: float = None, check_exists: bool = False,
+                               loop_enabled: bool = None, use_volume_envelope: bool = None):
         """
         Adds an audio custom event to the pattern.
 
@@ -191,14 +839,35 @@ class AHAP:
             wav_filepath (str): The path to the WAV file containing the sound.
             volume (float): The volume of the audio event.
                 Should be a float between 0 and 1.
+            pitch (float): Optional pitch of the audio event, between -1 and 1.
+            pan (float): Optional stereo pan of the audio event, between -1 (left) and 1 (right).
+            brightness (float): Optional brightness of the audio event, between 0 and 1.
+            check_exists (bool): If True, warn when wav_filepath doesn't exist on disk.
+            loop_enabled (bool): Optionally set EventWaveformLoopEnabled, to loop the waveform.
+            use_volume_envelope (bool): Optionally set EventWaveformUseVolumeEnvelope, to apply the audio attack/decay/release envelope to the waveform.
+
+        Raises:
+            ValueError: If wav_filepath is empty.
         """
+        if not wav_filepath:
+            raise ValueError("An AudioCustom event needs a waveform path.")
+        if check_exists and not os.path.isfile(wav_filepath):
+            warnings.warn(f"Waveform file {wav_filepath} doesn't exist.")
         parameters = [
             {
                 "ParameterID": ParamID.A_Volume.value,
                 "ParameterValue": volume,
             }
         ]
+        for param, value in ((ParamID.A_Pitch, pitch), (ParamID.A_Pan, pan), (ParamID.A_Brightness, brightness)):
+            if value is not None:
+                parameters.append({"ParameterID": param.value, "ParameterValue": value})
         self.add_event(etype="AudioCustom", time=time, parameters=parameters, event_waveform_path=wav_filepath)
+        event = self.data["Pattern"][-1]["Event"]
+        if loop_enabled is not None:
+            event["EventWaveformLoopEnabled"] = loop_enabled
+        if use_volume_envelope is not None:
+            event["EventWaveformUseVolumeEnvelope"] = use_volume_envelope
 
     def add_parameter_curve(self, parameter_id: CurveParamID, start_time: float, control_points: List[HapticCurve]):
         """
@@ -212,66 +881,1082 @@ class AHAP:
             control_points (List[HapticCurve]): The list of control points for the curve.
                 Should be a list of HapticCurve objects.
         """
+        self._add_curve(parameter_id, start_time+self.time_offset, control_points)
+
+    def _add_curve(self, parameter_id: CurveParamID, time: float, control_points: List[HapticCurve], channel: int = None):
+        # every curve goes through here, so set_curve_tolerance applies to all of them. time is absolute, without time_offset.
+        if self.curve_tolerance is not None:
+            control_points = simplify_curve(control_points, self.curve_tolerance)
         pattern = {
             "ParameterCurve": {
                 "ParameterID": parameter_id.value,
-                "Time": start_time,
+                "Time": time,
                 "ParameterCurveControlPoints": curves(control_points)
             }
         }
+        self._add_to_pattern(pattern)
+        if channel is not None:
+            _set_channel(pattern, channel)
 
-        self.data["Pattern"].append(pattern)
+    def add_audio_curve(self, parameter_id: CurveParamID, start_time: float, control_points: List[HapticCurve]):
+        """
+        Adds a curve for an audio parameter, like a volume fade or a pan sweep.
+        Control point values are clamped to the range of the parameter, -1 to 1 for pan and pitch.
 
-    def __repr__(self):
+        Args:
+            parameter_id (CurveParamID): One of the audio parameters: A_Brightness, A_Pan, A_Pitch, A_Volume, A_AttackTime, A_DecayTime, A_ReleaseTime.
+            start_time (float): The time of the start of the curve in seconds.
+            control_points (List[HapticCurve]): The control points, relative to start_time.
+
+        Raises:
+            ValueError: If parameter_id is not an audio parameter.
+        """
+        if not parameter_id.value.startswith("Audio"):
+            raise ValueError(f"{parameter_id.value} is not an audio parameter.")
+        self.add_parameter_curve(parameter_id, start_time, [HapticCurve(p.time, clamp_parameter(parameter_id, p.parameter_value)) for p in control_points])
+
+    def add_curve_for(self, event_index: int, parameter_id: CurveParamID, control_points: List[HapticCurve]):
         """
-        Print the data of the AHAP object.
+        Adds a parameter curve that starts at the time of a continuous event, so they can't get out of sync.
+
+        Args:
+            event_index (int): The index of the continuous event in the pattern.
+            parameter_id (CurveParamID): The parameter to dynamically change.
+            control_points (List[HapticCurve]): The control points, relative to the start of the event.
+
+        Raises:
+            ValueError: If there is no continuous event at event_index.
         """
-        repr(self.data)
+        pattern = self.data["Pattern"]
+        if not -len(pattern) <= event_index < len(pattern) or not pattern[event_index].get("Event", {}).get("EventType", "").endswith("Continuous"):
+            raise ValueError(f"Pattern[{event_index}] is not a continuous event.")
+        self._add_curve(parameter_id, pattern[event_index]["Event"]["Time"], control_points)
 
-    def export(self, filename: str, path: str = ".", **kwargs):
+    def add_dynamic_parameter(self, parameter_id: CurveParamID, time: float, value: float):
         """
-        Export the AHAP object to a JSON file.
+        Adds a dynamic parameter to the pattern. Unlike a curve it's a single step change that applies from its time on.
 
         Args:
-            filename (str): The name of the output file.
-            path (str): The path to the output directory.
-            **kwargs: Extra arguments you want to pass on to json.dumps(). For example, indent=4 for a pretty formatted JSON. 
+            parameter_id (CurveParamID): The parameter to change.
+            time (float): The time of the change in seconds.
+            value (float): The new value of the parameter.
         """
-        with open(os.path.join(path, filename), 'w') as f:
-            f.write(json.dumps(self.data, **kwargs))
+        pattern = {
+            "Parameter": {
+                "ParameterID": parameter_id.value,
+                "Time": time+self.time_offset,
+                "ParameterValue": value
+            }
+        }
 
-    def __call__(self, *args: Any, **kwds: Any) -> Any:
-        self.export(*args, **kwds)
+        self._add_to_pattern(pattern)
 
-    def __add__(self, other: AHAP):
-        """adds 2 ahap files. Attension, it smooshes them one on another, it doesn't work as expected now. Please don't use this method if you don't want to really smoosh them.
+    def scale_from(self, time: float, parameter_id, value: float):
+        """
+        Scales a parameter of the whole pattern from the given time on, for example to duck all intensity to 0.5 at 2 seconds.
+        This is a dynamic parameter, so no event has to be edited.
 
         Args:
-            other (AHAP): another Ahap class.
+            time (float): The time in seconds.
+            parameter_id (CurveParamID or ParamID): The control parameter to change.
+                An event parameter such as ParamID.H_Intensity is mapped to its control parameter (HapticIntensityControl).
+            value (float): The new value of the control parameter.
         """
-        data = {
-            "Version": 1.0,
-            "Metadata": {
-                "Project": "Basis",
-                "Created": str(datetime.datetime.now()),
-                "Description": self.data["Metadata"]["Description"],
-                "Created By": self.data["Metadata"]["Created By"]
-            },
-            "Pattern": self.data["Pattern"]+other.data["Pattern"]
-        }
+        if isinstance(parameter_id, ParamID):
+            parameter_id = CurveParamID(parameter_id.value+"Control")
+        self.add_dynamic_parameter(parameter_id, time, value)
 
-def freq(n: int, normalize: bool=True) -> float:
-    """
-    calculates the haptic sharpness value from frequency in hz.
+    def add_preset(self, time: float, preset: Preset):
+        """
+        Adds the events of a preset, see PRESETS.
 
-    Args:
-        n (int): The input frequency value.
-        normalize (bool): if normalizing, all high frequencies will be 230 and all low will be 80 if value is too high or too low.
-    Returns:
-        float: The normalized frequency value between 0 and 1.
+        Args:
+            time (float): The start time of the preset in seconds.
+            preset (Preset): The preset to add.
+        """
+        for etype, t, intensity, sharpness, *duration in PRESETS[preset]:
+            if etype == "HapticTransient":
+                self.add_haptic_transient_event(time+t, intensity, sharpness)
+            else:
+                self.add_haptic_continuous_event(time+t, duration[0], intensity, sharpness)
 
-    Raises:
-        ValueError: If the input frequency is less than 80 or greater than 230.
+    def for_each_event(self, fn: Callable[[int, dict], Any]):
+        """
+        Calls fn for every event of the pattern.
+
+        Args:
+            fn (Callable[[int, dict], Any]): Gets the pattern index and the "Event" dictionary, which can be modified in place.
+        """
+        for i, p in enumerate(self.data["Pattern"]):
+            if "Event" in p:
+                fn(i, p["Event"])
+
+    def for_each_curve(self, fn: Callable[[int, dict], Any]):
+        """
+        Calls fn for every parameter curve of the pattern.
+
+        Args:
+            fn (Callable[[int, dict], Any]): Gets the pattern index and the "ParameterCurve" dictionary, which can be modified in place.
+        """
+        for i, p in enumerate(self.data["Pattern"]):
+            if "ParameterCurve" in p:
+                fn(i, p["ParameterCurve"])
+
+    def events_in_range(self, start: float, end: float) -> List[dict]:
+        """
+        Finds the events that play between start and end. Continuous events that start earlier but reach into the range are included.
+
+        Args:
+            start (float): The start of the range in seconds.
+            end (float): The end of the range in seconds, not included.
+
+        Returns:
+            List[dict]: The "Event" dictionaries, in pattern order.
+        """
+        events = []
+        for p in self.data["Pattern"]:
+            if "Event" not in p:
+                continue
+            p_start, p_end = pattern_span(p)
+            if p_start < end and (p_end > start or start <= p_start):
+                events.append(p["Event"])
+        return events
+
+    def duration(self) -> float:
+        """
+        Get the length of the pattern: the time when the last event or curve ends, including the ones in tracks.
+
+        Returns:
+            float: The duration in seconds, 0 for an empty pattern.
+        """
+        return max([pattern_span(p)[1] for p in self._merged_pattern()], default=0.0)
+
+    def append(self, other: 'AHAP'):
+        """
+        Adds the pattern of another AHAP right after the end of this one.
+
+        Args:
+            other (AHAP): The AHAP to append. It is not modified.
+        """
+        offset = self.duration()
+        for p in copy.deepcopy(other.data["Pattern"]):
+            next(iter(p.values()))["Time"] += offset
+            self.data["Pattern"].append(p)
+
+    def fade_in(self, duration: float):
+        """
+        Fades the first seconds of the pattern in from zero intensity.
+        If a continuous event plays during the fade, a single intensity curve over the fade scales everything in it, transients included.
+        Otherwise there is nothing for a curve to shape, so the intensity of each transient is scaled by the fade at its time instead.
+
+        Args:
+            duration (float): The length of the fade in seconds.
+        """
+        self._fade(0.0, duration, lambda t: min(max(t/duration, 0.0), 1.0))
+
+    def fade_out(self, duration: float):
+        """
+        Fades the last seconds of the pattern out to zero intensity. See fade_in.
+
+        Args:
+            duration (float): The length of the fade in seconds.
+        """
+        end = self.duration()
+        self._fade(end-duration, end, lambda t: min(max((end-t)/duration, 0.0), 1.0))
+
+    def _fade(self, start: float, end: float, factor: Callable[[float], float]):
+        start = max(start, 0.0)
+        if end <= start:
+            return
+        events = [p["Event"] for p in self._merged_pattern() if "Event" in p]
+        if any(e["EventType"] == "HapticContinuous" and e["Time"] < end and e["Time"]+e["EventDuration"] > start for e in events):
+            self._add_curve(CurveParamID.H_Intensity, start, [HapticCurve(0.0, factor(start)), HapticCurve(end-start, factor(end))])
+            return
+        for event in events:
+            if event["EventType"] == "HapticTransient" and start <= event["Time"] <= end:
+                for param in event["EventParameters"]:
+                    if param["ParameterID"] == ParamID.H_Intensity.value:
+                        param["ParameterValue"] *= factor(event["Time"])
+
+    def add_ramp(self, time: float, duration: float, from_intensity: float, to_intensity: float, haptic_sharpness: float = None, steps: int = 10):
+        """
+        Adds a haptic continuous event together with an intensity curve that ramps over it.
+        The curve starts at the event's time, so they can't get out of sync. The event plays at intensity 1, so the curve values
+        are the intensities you feel. The curve controls every event playing at the same time, and a dynamic parameter at the end
+        of the event sets the intensity control back to 1.
+
+        Args:
+            time (float): The time of the event in seconds.
+            duration (float): The duration of the event and the ramp in seconds.
+            from_intensity (float): The intensity at the start of the ramp.
+            to_intensity (float): The intensity at the end of the ramp.
+            haptic_sharpness (float): The sharpness of the event.
+            steps (int): The number of control points in the curve, at least 2.
+        """
+        self.add_haptic_continuous_event(time, duration, 1.0, haptic_sharpness)
+        self.add_parameter_curve(CurveParamID.H_Intensity, time, ramp_curve(duration, from_intensity, to_intensity, steps))
+        self.add_dynamic_parameter(CurveParamID.H_Intensity, time+duration, 1.0)
+
+    def add_sharpness_ramp(self, time: float, duration: float, from_sharpness: float, to_sharpness: float, haptic_intensity: float = None, steps: int = 10):
+        """
+        Adds a haptic continuous event together with a sharpness curve that ramps over it.
+        The sharpness control is added to the sharpness of the events, so the event has sharpness 0 and the curve values
+        are the sharpness you feel. A dynamic parameter at the end of the event sets the sharpness control back to 0.
+
+        Args:
+            time (float): The time of the event in seconds.
+            duration (float): The duration of the event and the ramp in seconds.
+            from_sharpness (float): The sharpness at the start of the ramp.
+            to_sharpness (float): The sharpness at the end of the ramp.
+            haptic_intensity (float): The intensity of the event.
+            steps (int): The number of control points in the curve, at least 2.
+        """
+        self.add_haptic_continuous_event(time, duration, haptic_intensity, 0.0)
+        self.add_parameter_curve(CurveParamID.H_Sharpness, time, ramp_curve(duration, from_sharpness, to_sharpness, steps))
+        self.add_dynamic_parameter(CurveParamID.H_Sharpness, time+duration, 0.0)
+
+    def add_pan_sweep(self, time: float, duration: float, from_pan: float, to_pan: float, steps: int = 10):
+        """
+        Adds an audio pan curve that moves the sound from one side to the other, for example over an AudioContinuous event.
+
+        Args:
+            time (float): The start time of the sweep in seconds.
+            duration (float): The length of the sweep in seconds.
+            from_pan (float): The pan at the start, between -1 (left) and 1 (right).
+            to_pan (float): The pan at the end, between -1 (left) and 1 (right).
+            steps (int): The number of control points in the curve, at least 2.
+        """
+        self.add_parameter_curve(CurveParamID.A_Pan, time, ramp_curve(duration, from_pan, to_pan, steps))
+
+    def add_pitch_melody(self, time: float, notes: List[int], note_duration: float, base_note: int = 60, volume: float = 0.75, glide: float = 0.01):
+        """
+        Adds an AudioContinuous event that plays a melody, through an audio pitch curve that steps from note to note.
+        Each semitone away from base_note moves the pitch by 1/12, so the melody can span an octave up and down
+        before the pitch gets clamped to -1 and 1.
+
+        Args:
+            time (float): The start time of the melody in seconds.
+            notes (List[int]): The MIDI note numbers of the melody.
+            note_duration (float): The length of each note in seconds.
+            base_note (int): The MIDI note played at pitch 0.
+            volume (float): The volume of the audio event, between 0 and 1.
+            glide (float): The time in seconds the pitch takes to move to the next note, shorter than note_duration.
+
+        Raises:
+            ValueError: If glide is negative or not shorter than note_duration.
+        """
+        if not 0 <= glide < note_duration:
+            raise ValueError(f"The glide ({glide}) must be at least 0 and shorter than the note duration ({note_duration})")
+        if not notes:
+            return
+        points = []
+        for i, n in enumerate(notes):
+            pitch = (n-base_note)/12
+            end = (i+1)*note_duration-(glide if i < len(notes)-1 else 0.0)
+            points += [HapticCurve(i*note_duration, pitch), HapticCurve(end, pitch)]
+        self.add_audio_continuous_event(time, len(notes)*note_duration, volume)
+        self.add_audio_curve(CurveParamID.A_Pitch, time, points)
+
+    def add_heartbeat(self, start_time: float, bpm: float = 60, count: int = 1, intensity: float = 1.0):
+        """
+        Adds heartbeats: each one is a lub-dub pair of transients 0.12 seconds apart, the dub softer than the lub.
+
+        Args:
+            start_time (float): The time of the first lub in seconds.
+            bpm (float): The heart rate in beats per minute.
+            count (int): The number of heartbeats.
+            intensity (float): The intensity of the lub. The dub gets 70% of it.
+        """
+        for i in range(count):
+            time = start_time+i*60/bpm
+            self.add_haptic_transient_event(time, intensity, 0.3)
+            self.add_haptic_transient_event(time+0.12, intensity*0.7, 0.2)
+
+    def add_continuous_adsr(self, time: float, duration: float, peak_intensity: float, sustain_intensity: float, haptic_sharpness: float,
+                            attack: float, decay: float, release: float):
+        """
+        Adds a haptic continuous event shaped by an attack/decay/sustain/release intensity curve.
+        The intensity rises from 0 to peak_intensity over attack, falls to sustain_intensity over decay,
+        holds and then drops to 0 over the last release seconds of the event.
+        The event itself plays at intensity 1, so the curve values are the intensities you feel. The curve controls every event
+        playing at the same time, and a dynamic parameter at the end of the event sets the intensity control back to 1.
+
+        Args:
+            time (float): The time of the event in seconds.
+            duration (float): The duration of the event in seconds.
+            peak_intensity (float): The intensity at the end of the attack.
+            sustain_intensity (float): The intensity held between decay and release.
+            haptic_sharpness (float): The sharpness of the event.
+            attack (float): The attack time in seconds.
+            decay (float): The decay time in seconds.
+            release (float): The release time in seconds.
+
+        Raises:
+            ValueError: If attack, decay and release don't fit into duration.
+        """
+        if attack+decay+release > duration:
+            raise ValueError(f"attack+decay+release ({attack+decay+release}) is longer than the duration ({duration})")
+        self.add_haptic_continuous_event(time, duration, 1.0, haptic_sharpness)
+        self.add_parameter_curve(CurveParamID.H_Intensity, time, [
+            HapticCurve(0.0, 0.0),
+            HapticCurve(attack, peak_intensity),
+            HapticCurve(attack+decay, sustain_intensity),
+            HapticCurve(duration-release, sustain_intensity),
+            HapticCurve(duration, 0.0),
+        ])
+        self.add_dynamic_parameter(CurveParamID.H_Intensity, time+duration, 1.0)
+
+    def add_soft_transient(self, time: float, haptic_intensity: float = None, haptic_sharpness: float = None, decay: float = 0.05):
+        """
+        Adds a transient followed by a short continuous event that fades out, for devices that play transients too abruptly.
+        The fade is an intensity curve, so it also fades every other event playing during the tail. At the end of the tail
+        a dynamic parameter sets the intensity control back to 1, so later events are not affected.
+
+        Args:
+            time (float): The time of the transient in seconds.
+            haptic_intensity (float): The intensity of the transient and the start of the tail. Defaults to the default intensity, see set_defaults.
+            haptic_sharpness (float): The sharpness of the transient and the tail. Defaults to the default sharpness.
+            decay (float): The length of the tail in seconds.
+        """
+        self.add_haptic_transient_event(time, haptic_intensity, haptic_sharpness)
+        self.add_haptic_continuous_event(time, decay, haptic_intensity, haptic_sharpness)
+        self.add_parameter_curve(CurveParamID.H_Intensity, time, ramp_curve(decay, 1.0, 0.0, 2))
+        self.add_dynamic_parameter(CurveParamID.H_Intensity, time+decay, 1.0)
+
+    def transpose_sharpness(self, semitones: float):
+        """
+        Shifts the sharpness of every haptic event as if it was a pitch.
+        The sharpness is converted to a frequency, shifted by the given number of semitones and converted back.
+        Frequencies that fall out of the 80-230 hz band are clamped to it.
+
+        Args:
+            semitones (float): The shift in semitones, negative to go down.
+        """
+        for p in self.data["Pattern"]:
+            if "Event" not in p:
+                continue
+            for param in p["Event"]["EventParameters"]:
+                if param["ParameterID"] == ParamID.H_Sharpness.value:
+                    f = sharpness_to_freq(min(max(param["ParameterValue"], 0.0), 1.0))
+                    param["ParameterValue"] = freq(f*2**(semitones/12))
+
+    def limit_density(self, window: float, max_events: int) -> int:
+        """
+        Thins dense bursts of transients so that no window of the given length holds more than max_events of them.
+        The strongest transients are kept and the weakest ones are dropped. Continuous events and curves are never touched.
+
+        Args:
+            window (float): The length of the sliding window in seconds.
+            max_events (int): The maximum number of transients allowed in any window.
+
+        Returns:
+            int: The number of dropped transients.
+        """
+        transients = [i for i, p in enumerate(self.data["Pattern"]) if "Event" in p and p["Event"]["EventType"] == "HapticTransient"]
+        transients.sort(key=lambda i: event_parameter(self.data["Pattern"][i]["Event"], ParamID.H_Intensity, 0.0), reverse=True)
+        kept = []
+        dropped = set()
+        for i in transients:
+            time = self.data["Pattern"][i]["Event"]["Time"]
+            # a window holding too many events can always be moved to start at one of them, and only windows holding time change.
+            starts = kept[bisect.bisect_right(kept, time-window):bisect.bisect_right(kept, time)]+[time]
+            if any(bisect.bisect_left(kept, start+window)-bisect.bisect_left(kept, start)+(time < start+window) > max_events for start in starts):
+                dropped.add(i)
+            else:
+                bisect.insort(kept, time)
+        self.data["Pattern"] = [p for i, p in enumerate(self.data["Pattern"]) if i not in dropped]
+        return len(dropped)
+
+    def overlapping_continuous(self) -> List[Tuple[int, int]]:
+        """
+        Finds haptic continuous events whose time spans overlap. Such events with conflicting parameters behave unpredictably on the device.
+
+        Returns:
+            List[Tuple[int, int]]: Pairs of pattern indices of overlapping events.
+        """
+        spans = [(i, p["Event"]["Time"], p["Event"]["Time"]+p["Event"]["EventDuration"]) for i, p in enumerate(self.data["Pattern"])
+                 if "Event" in p and p["Event"]["EventType"] == "HapticContinuous"]
+        return [(a[0], b[0]) for n, a in enumerate(spans) for b in spans[n+1:] if a[1] < b[2] and b[1] < a[2]]
+
+    def merge_overlapping_continuous(self) -> int:
+        """
+        Merges every group of overlapping haptic continuous events into one event that covers the whole group.
+        Its parameters are the averages of the merged events, weighted by their durations.
+
+        Returns:
+            int: The number of events that were merged away.
+        """
+        groups = {}
+        for a, b in self.overlapping_continuous():
+            group = groups.get(a, {a}) | groups.get(b, {b})
+            for i in group:
+                groups[i] = group
+        removed = set()
+        for group in {id(g): g for g in groups.values()}.values():
+            events = [self.data["Pattern"][i]["Event"] for i in sorted(group)]
+            total = sum(e["EventDuration"] for e in events)
+            merged = events[0]
+            for param in merged["EventParameters"]:
+                values = [(event_parameter(e, param["ParameterID"], param["ParameterValue"]), e["EventDuration"]) for e in events]
+                param["ParameterValue"] = sum(v*d for v, d in values)/total if total > 0 else param["ParameterValue"]
+            start = min(e["Time"] for e in events)
+            merged["EventDuration"] = max(e["Time"]+e["EventDuration"] for e in events)-start
+            merged["Time"] = start
+            removed |= set(sorted(group)[1:])
+        self.data["Pattern"] = [p for i, p in enumerate(self.data["Pattern"]) if i not in removed]
+        return len(removed)
+
+    def supported_version(self) -> bool:
+        """
+        Checks whether the AHAP format version of the data is one this module knows, see SUPPORTED_VERSIONS.
+
+        Returns:
+            bool: True if the version is supported.
+        """
+        return self.data.get("Version") in SUPPORTED_VERSIONS
+
+    def validate(self) -> List[str]:
+        """
+        Checks the pattern for mistakes that Core Haptics accepts silently but that don't do what was meant.
+        Tracks are checked too, and Pattern indices refer to the exported pattern with the tracks appended.
+
+        Returns:
+            List[str]: A description of every problem found, empty if there are none.
+        """
+        problems = []
+        if not self.supported_version():
+            problems.append(f"Version {self.data.get('Version')} is not supported, the pattern may not play as meant")
+        for i, p in enumerate(self._merged_pattern()):
+            entry = next(iter(p.values()))
+            if entry["Time"] < 0:
+                problems.append(f"Pattern[{i}] starts at a negative time ({entry['Time']})")
+            if "Event" in p and p["Event"]["EventType"].endswith("Continuous") and p["Event"].get("EventDuration", 0) <= 0:
+                problems.append(f"Pattern[{i}] is a {p['Event']['EventType']} event with a duration of {p['Event'].get('EventDuration', 0)}, it won't play")
+        return problems
+
+    def check_limits(self, max_events: int = 500, max_duration: float = 30.0, max_density: float = 15.0) -> List[str]:
+        """
+        Warns about patterns that are likely too heavy for Core Haptics. These are not hard errors, but such patterns
+        can fail to load or play badly on a device.
+
+        Args:
+            max_events (int): The maximum number of events.
+            max_duration (float): The maximum duration in seconds.
+            max_density (float): The maximum number of transients within any one second.
+
+        Returns:
+            List[str]: A human readable warning for every exceeded limit.
+        """
+        messages = []
+        events = [p["Event"] for p in self._merged_pattern() if "Event" in p]
+        if len(events) > max_events:
+            messages.append(f"The pattern has {len(events)} events, more than {max_events}")
+        if self.duration() > max_duration:
+            messages.append(f"The pattern is {self.duration():g} seconds long, longer than {max_duration:g}")
+        times = sorted(e["Time"] for e in events if e["EventType"] == "HapticTransient")
+        densest, at, first = 0, 0.0, 0
+        for last, t in enumerate(times):
+            while times[first] <= t-1.0+1e-9:
+                first += 1
+            if last-first+1 > densest:
+                densest, at = last-first+1, times[first]
+        if densest > max_density:
+            messages.append(f"There are {densest} transients within one second from {at:g} seconds, more than {max_density:g}")
+        return messages
+
+    def clamp(self) -> int:
+        """
+        Clamps every event parameter and curve control point into the legal range of its parameter, see parameter_range.
+
+        Returns:
+            int: The number of values that had to be changed.
+        """
+        changed = 0
+        for p in self._merged_pattern():
+            if "Event" in p:
+                values = [(param["ParameterID"], param) for param in p["Event"]["EventParameters"]]
+            elif "ParameterCurve" in p:
+                values = [(p["ParameterCurve"]["ParameterID"], point) for point in p["ParameterCurve"]["ParameterCurveControlPoints"]]
+            elif "Parameter" in p:
+                values = [(p["Parameter"]["ParameterID"], p["Parameter"])]
+            else:
+                continue
+            for parameter_id, value in values:
+                clamped = clamp_parameter(parameter_id, value["ParameterValue"])
+                if clamped != value["ParameterValue"]:
+                    value["ParameterValue"] = clamped
+                    changed += 1
+        return changed
+
+    def simplify_curves(self, tolerance: float) -> int:
+        """
+        Simplifies every curve in the pattern, see simplify_curve.
+
+        Args:
+            tolerance (float): How far the simplified curves may be from any removed point, in parameter units.
+
+        Returns:
+            int: The number of removed control points.
+        """
+        removed = 0
+        for p in self.data["Pattern"]:
+            if "ParameterCurve" not in p:
+                continue
+            points = p["ParameterCurve"]["ParameterCurveControlPoints"]
+            simplified = _douglas_peucker([(point["Time"], point["ParameterValue"]) for point in points], tolerance)
+            removed += len(points)-len(simplified)
+            p["ParameterCurve"]["ParameterCurveControlPoints"] = [{"Time": t, "ParameterValue": v} for t, v in simplified]
+        return removed
+
+    def auto_release(self, release: float = 0.05) -> int:
+        """
+        Adds a fade out over the last release seconds of every haptic continuous event, so they don't stop abruptly.
+        Events that already have an intensity curve ending with them are left alone, so calling it twice adds nothing.
+        The fade is an intensity curve, so it also fades other events playing at that time. A dynamic parameter at the end of the event
+        sets the intensity control back to 1, so the fade doesn't reach past the event.
+
+        Args:
+            release (float): The length of the fade in seconds. Shorter events fade over their whole duration.
+
+        Returns:
+            int: The number of added curves.
+        """
+        ends = [pattern_span(p)[1] for p in self.data["Pattern"]
+                if "ParameterCurve" in p and p["ParameterCurve"]["ParameterID"] == CurveParamID.H_Intensity.value]
+        added = 0
+        for p in list(self.data["Pattern"]):
+            if "Event" not in p or p["Event"]["EventType"] != "HapticContinuous":
+                continue
+            start, end = pattern_span(p)
+            if any(abs(e-end) < 1e-9 for e in ends):
+                continue
+            fade = min(release, end-start)
+            self._add_curve(CurveParamID.H_Intensity, end-fade, [HapticCurve(0.0, 1.0), HapticCurve(fade, 0.0)], _channel(p))
+            restore = {"Parameter": {"ParameterID": CurveParamID.H_Intensity.value, "Time": end, "ParameterValue": 1.0}}
+            self._add_to_pattern(restore)
+            _set_channel(restore, _channel(p))
+            ends.append(end)
+            added += 1
+        return added
+
+    def sort(self):
+        """Sorts the pattern and every track by start time. Entries that start at the same time keep their order."""
+        self.data["Pattern"].sort(key=lambda p: pattern_span(p)[0])
+        for track in self.tracks.values():
+            track.sort()
+
+    def dedupe_transients(self, epsilon: float = 1e-6) -> int:
+        """
+        Removes transients that start at the same time as another one, as they play as a single, stronger tap.
+        Of each group only the most intense transient is kept.
+
+        Args:
+            epsilon (float): Transients closer together than this, in seconds, count as coincident.
+                Chains of transients each closer than this to the next form one group.
+
+        Returns:
+            int: The number of removed transients.
+        """
+        pattern = self._merged_pattern()
+        transients = sorted((p["Event"]["Time"], i) for i, p in enumerate(pattern)
+                            if "Event" in p and p["Event"]["EventType"] == "HapticTransient")
+        groups = []
+        for n, (time, i) in enumerate(transients):
+            if n > 0 and time-transients[n-1][0] < epsilon:
+                groups[-1].append(i)
+            else:
+                groups.append([i])
+        removed = set()
+        for group in groups:
+            strongest = max(group, key=lambda i: event_parameter(pattern[i]["Event"], ParamID.H_Intensity, 0.0))
+            removed |= {id(pattern[i]) for i in group if i != strongest}
+        self._remove_entries(removed)
+        return len(removed)
+
+    def _remove_entries(self, ids: set):
+        self.data["Pattern"] = [p for p in self.data["Pattern"] if id(p) not in ids]
+        for track in self.tracks.values():
+            track._remove_entries(ids)
+
+    def finalize(self):
+        """
+        Prepares the pattern for shipping: sorts it, clamps all values, removes coincident transients and validates it.
+        Every step covers the tracks as well.
+        Each step is also available on its own, see sort, clamp, dedupe_transients and validate.
+
+        Raises:
+            ValueError: If validation finds a problem, with the first problem as the message.
+        """
+        self.sort()
+        self.clamp()
+        self.dedupe_transients()
+        problems = self.validate()
+        if problems:
+            raise ValueError(problems[0])
+
+    def trim_before(self, time: float):
+        """
+        Removes everything that ends before the given time. Continuous events that start earlier but end later are cut to start at it.
+
+        Args:
+            time (float): The time in seconds.
+        """
+        kept = []
+        for p in self.data["Pattern"]:
+            start, end = pattern_span(p)
+            if end < time:
+                continue
+            if "Event" in p and "EventDuration" in p["Event"] and start < time:
+                p["Event"]["EventDuration"] = end-time
+                p["Event"]["Time"] = time
+            kept.append(p)
+        self.data["Pattern"] = kept
+
+    def trim_after(self, time: float):
+        """
+        Removes everything that starts after the given time. Continuous events that run past it are cut to end at it.
+
+        Args:
+            time (float): The time in seconds.
+        """
+        kept = []
+        for p in self.data["Pattern"]:
+            start, end = pattern_span(p)
+            if start > time:
+                continue
+            if "Event" in p and "EventDuration" in p["Event"] and end > time:
+                p["Event"]["EventDuration"] = time-start
+            kept.append(p)
+        self.data["Pattern"] = kept
+
+    def trim_silence(self) -> float:
+        """
+        Removes the silence at the start by moving everything back so that the pattern starts at time 0.
+        Comments and the loop markers move too, comments in the removed silence are dropped.
+        The silence at the end needs no trimming, the duration already ends with the last event or curve.
+
+        Returns:
+            float: The time in seconds everything was moved back by.
+        """
+        shift = min([pattern_span(p)[0] for p in self.data["Pattern"]], default=0.0)
+        for p in self.data["Pattern"]:
+            next(iter(p.values()))["Time"] -= shift
+        _move_markers(self.data["Metadata"], shift, math.inf)
+        return shift
+
+    def slice(self, start: float, end: float) -> 'AHAP':
+        """
+        Extracts the content between start and end into a new AHAP that starts at time 0.
+        Continuous events and curves that cross the boundaries are clipped, curves get interpolated points at the cuts.
+        Comments outside the slice are dropped, and the loop is clipped to the slice or dropped if it lies outside.
+
+        Args:
+            start (float): The start of the slice in seconds.
+            end (float): The end of the slice in seconds, not included.
+
+        Returns:
+            AHAP: The new AHAP with a copy of the metadata.
+        """
+        sliced = AHAP()
+        sliced.data = copy.deepcopy({k: v for k, v in self.data.items() if k != "Pattern"})
+        sliced.data["Pattern"] = []
+        _move_markers(sliced.data["Metadata"], start, end)
+        for p in copy.deepcopy(self.data["Pattern"]):
+            p_start, p_end = pattern_span(p)
+            if "ParameterCurve" in p:
+                curve = p["ParameterCurve"]
+                if p_end < start or p_start >= end:
+                    continue
+                points = [(curve["Time"]+point["Time"], point["ParameterValue"]) for point in curve["ParameterCurveControlPoints"]]
+                clipped = [(t, v) for t, v in points if start <= t <= end]
+                for cut in (start, end):
+                    for (t0, v0), (t1, v1) in zip(points, points[1:]):
+                        if t0 < cut < t1:
+                            clipped.append((cut, v0+(v1-v0)*(cut-t0)/(t1-t0)))
+                clipped.sort()
+                curve["Time"] = max(p_start, start)
+                curve["ParameterCurveControlPoints"] = [{"Time": t-curve["Time"], "ParameterValue": v} for t, v in clipped]
+                curve["Time"] -= start
+            elif "Event" in p and "EventDuration" in p["Event"]:
+                if p_end <= start or p_start >= end:
+                    continue
+                p["Event"]["Time"] = max(p_start, start)-start
+                p["Event"]["EventDuration"] = min(p_end, end)-max(p_start, start)
+            else:
+                if not start <= p_start < end:
+                    continue
+                next(iter(p.values()))["Time"] -= start
+            sliced.data["Pattern"].append(p)
+        return sliced
+
+    def render_timeline(self, width: int = 80) -> str:
+        """
+        Draws the pattern as text, for a quick look in the terminal.
+        The events lane shows transients as | and continuous events as =,
+        the intensity and sharpness lanes show the value of the strongest event in each column as a digit from 0 to 9.
+
+        Args:
+            width (int): The number of columns for the whole duration of the pattern.
+
+        Returns:
+            str: Three lines, each starting with a 10 character lane name.
+        """
+        total = self.duration()
+        lanes = {"events": [" "]*width, "intensity": [" "]*width, "sharpness": [" "]*width}
+        levels = {"intensity": [-1]*width, "sharpness": [-1]*width}
+
+        def column(t):
+            return min(int(t/total*(width-1)+0.5), width-1) if total > 0 else 0
+
+        for p in self.data["Pattern"]:
+            if "Event" not in p or not p["Event"]["EventType"].startswith("Haptic"):
+                continue
+            start, end = pattern_span(p)
+            columns = range(column(start), column(end)+1)
+            for c in columns:
+                if lanes["events"][c] != "|":
+                    lanes["events"][c] = "|" if p["Event"]["EventType"] == "HapticTransient" else "="
+            for lane, param in (("intensity", ParamID.H_Intensity), ("sharpness", ParamID.H_Sharpness)):
+                level = round(min(max(event_parameter(p["Event"], param, 0.0), 0.0), 1.0)*9)
+                for c in columns:
+                    if level > levels[lane][c]:
+                        levels[lane][c] = level
+                        lanes[lane][c] = str(level)
+        return "\n".join(f"{name:<10}{''.join(cells)}" for name, cells in lanes.items())
+
+    def stats(self) -> dict:
+        """
+        Get statistics about the pattern, including the tracks.
+
+        Returns:
+            dict: With the keys
+                "events": the number of events per event type,
+                "curves": the number of curves per parameter,
+                "duration": the duration in seconds,
+                "intensity" and "sharpness": dictionaries with the "min", "max" and "mean" over the haptic events, or None if there are none,
+                "transient_density": the average number of transients per second.
+        """
+        events, curves = {}, {}
+        values = {"intensity": [], "sharpness": []}
+        for p in self._merged_pattern():
+            if "Event" in p:
+                event = p["Event"]
+                events[event["EventType"]] = events.get(event["EventType"], 0)+1
+                if event["EventType"].startswith("Haptic"):
+                    for name, param in (("intensity", ParamID.H_Intensity), ("sharpness", ParamID.H_Sharpness)):
+                        value = event_parameter(event, param)
+                        if value is not None:
+                            values[name].append(value)
+            elif "ParameterCurve" in p:
+                parameter_id = p["ParameterCurve"]["ParameterID"]
+                curves[parameter_id] = curves.get(parameter_id, 0)+1
+        duration = self.duration()
+        stats = {"events": events, "curves": curves, "duration": duration,
+                 "transient_density": events.get("HapticTransient", 0)/duration if duration > 0 else 0.0}
+        for name, v in values.items():
+            stats[name] = {"min": min(v), "max": max(v), "mean": sum(v)/len(v)} if v else None
+        return stats
+
+    def energy_estimate(self) -> float:
+        """
+        Gives a rough estimate of the energy the actuator spends on the pattern, useful to compare two designs.
+        A continuous event costs its intensity times its duration, a transient costs its intensity times TRANSIENT_ENERGY,
+        as if it was a continuous event that short. Curves and audio events are not taken into account.
+
+        Returns:
+            float: The estimate in intensity-seconds.
+        """
+        energy = 0.0
+        for p in self._merged_pattern():
+            if "Event" not in p:
+                continue
+            intensity = event_parameter(p["Event"], ParamID.H_Intensity, 0.0)
+            if p["Event"]["EventType"] == "HapticContinuous":
+                energy += intensity*p["Event"]["EventDuration"]
+            elif p["Event"]["EventType"] == "HapticTransient":
+                energy += intensity*TRANSIENT_ENERGY
+        return energy
+
+    def check_curve_overruns(self) -> List[Tuple[int, float]]:
+        """
+        Finds parameter curves whose control points extend beyond the continuous event they start in.
+        Control point times are relative to the curve's Time, so a curve runs until Time plus its last point time.
+
+        Returns:
+            List[Tuple[int, float]]: (pattern index of the curve, overshoot in seconds) for every curve that falls off the end of its event.
+        """
+        events = [p["Event"] for p in self.data["Pattern"] if "Event" in p and p["Event"]["EventType"].endswith("Continuous")]
+        overruns = []
+        for index, p in enumerate(self.data["Pattern"]):
+            if "ParameterCurve" not in p:
+                continue
+            curve = p["ParameterCurve"]
+            points = curve["ParameterCurveControlPoints"]
+            if not points:
+                continue
+            ends = [e["Time"]+e["EventDuration"] for e in events if e["Time"] <= curve["Time"] < e["Time"]+e["EventDuration"]]
+            if not ends:
+                continue
+            overshoot = curve["Time"]+max(point["Time"] for point in points)-max(ends)
+            if overshoot > 1e-9:
+                overruns.append((index, overshoot))
+        return overruns
+
+    def __repr__(self):
+        """
+        Get the data of the AHAP object.
+        """
+        return repr(self.data)
+
+    def __str__(self):
+        """
+        Get a short summary for debugging: a header with the number of events and the duration, then one line per pattern entry.
+        """
+        events = sum("Event" in p for p in self.data["Pattern"])
+        lines = [f"AHAP \"{self.data['Metadata'].get('Description', '')}\": {events} events, {len(self.data['Pattern'])} entries, {self.duration():g} seconds"]
+        lines += ["  "+describe_entry(p) for p in self.data["Pattern"]]
+        return "\n".join(lines)
+
+    def track(self, name: str) -> 'AHAP':
+        """
+        Get a track: a separate AHAP inside this one for one logical part, like drums or bass.
+        The exports, duration and stats merge all tracks with the pattern of this AHAP, export_tracks writes one file per track.
+
+        Args:
+            name (str): The name of the track. It's created with the metadata of this AHAP the first time.
+
+        Returns:
+            AHAP: The track.
+        """
+        if name not in self.tracks:
+            track = AHAP()
+            track.data["Version"] = self.data["Version"]
+            track.data["Metadata"] = copy.deepcopy(self.data["Metadata"])
+            track.data["Metadata"]["Description"] = f"{self.data['Metadata'].get('Description', '')} ({name})"
+            self.tracks[name] = track
+        return self.tracks[name]
+
+    def _merged_pattern(self) -> List[dict]:
+        pattern = list(self.data["Pattern"])
+        for track in self.tracks.values():
+            pattern += track._merged_pattern()
+        return pattern
+
+    def _export_data(self) -> dict:
+        return dict(self.data, Pattern=[_untagged(p) for p in self._merged_pattern()])
+
+    def export_tracks(self, path: str = ".", **kwargs) -> List[str]:
+        """
+        Export every track to its own file, named after the track.
+
+        Args:
+            path (str): The path to the output directory.
+            **kwargs: Extra arguments passed on to export().
+
+        Returns:
+            List[str]: The names of the written files.
+        """
+        filenames = []
+        for name, track in self.tracks.items():
+            track.export(f"{name}.ahap", path, **kwargs)
+            filenames.append(f"{name}.ahap")
+        return filenames
+
+    def export(self, filename: str, path: str = ".", legacy_keys: bool = False, grid: float = None, compact_curves: bool = False, **kwargs):
+        """
+        Export the AHAP object to a JSON file. The patterns of all tracks are merged into it.
+
+        Args:
+            filename (str): The name of the output file.
+            path (str): The path to the output directory.
+            legacy_keys (bool): Write the metadata keys of LEGACY_KEYS in their old form, for players that reject the modern ones.
+            grid (float): Round every time, including curve control points, to the nearest multiple of this many seconds, e.g. 0.001.
+            compact_curves (bool): Write the control points of each curve on a single line, even with indent. Keeps long curves readable.
+            **kwargs: Extra arguments you want to pass on to json.dumps(). For example, indent=4 for a pretty formatted JSON. 
+        """
+        self._close_until_next()
+        data = self._export_data()
+        if legacy_keys:
+            data = dict(data, Metadata={LEGACY_KEYS.get(k, k): v for k, v in data["Metadata"].items()})
+        if grid:
+            data = dict(data, Pattern=copy.deepcopy(data["Pattern"]))
+            for p in data["Pattern"]:
+                entry = next(iter(p.values()))
+                for item in [entry]+entry.get("ParameterCurveControlPoints", []):
+                    item["Time"] = round(round(item["Time"]/grid)*grid, 9)
+        points = []
+        if compact_curves:
+            # The placeholders must not appear anywhere else in the file, or a comment could be replaced instead of a curve
+            marker = f"@{uuid.uuid4().hex}"
+            while marker in json.dumps(data):
+                marker = f"@{uuid.uuid4().hex}"
+            data = dict(data, Pattern=[dict(p) for p in data["Pattern"]])
+            for p in data["Pattern"]:
+                if "ParameterCurve" in p:
+                    points.append(p["ParameterCurve"]["ParameterCurveControlPoints"])
+                    p["ParameterCurve"] = dict(p["ParameterCurve"], ParameterCurveControlPoints=f"{marker}{len(points)-1}@")
+        text = json.dumps(data, **kwargs)
+        for i, curve in enumerate(points):
+            text = text.replace(f'"{marker}{i}@"', json.dumps(curve), 1)
+        with open(os.path.join(path, filename), 'w') as f:
+            f.write(text)
+
+    def export_preview_wav(self, filename: str, path: str = ".", sample_rate: int = 44100):
+        """
+        Renders the haptic events into a mono 16-bit WAV file, to get an idea of the pattern without a device.
+        Transients become short decaying clicks and continuous events become tones. The pitch comes from the sharpness (see sharpness_to_freq),
+        the loudness from the intensity, and HapticIntensityControl curves scale the continuous events they cover.
+
+        Args:
+            filename (str): The name of the output file.
+            path (str): The path to the output directory.
+            sample_rate (int): The sample rate in hz.
+        """
+        self._close_until_next()
+        samples = [0.0]*(int((self.duration()+CLICK_LENGTH)*sample_rate)+1)
+        # the absolute control points of every intensity curve, worked out once instead of for every sample.
+        intensity_curves = []
+        for p in self._merged_pattern():
+            if "ParameterCurve" in p and p["ParameterCurve"]["ParameterID"] == CurveParamID.H_Intensity.value and p["ParameterCurve"]["ParameterCurveControlPoints"]:
+                curve = p["ParameterCurve"]
+                points = sorted((curve["Time"]+point["Time"], point["ParameterValue"]) for point in curve["ParameterCurveControlPoints"])
+                intensity_curves.append(([t for t, v in points], [v for t, v in points]))
+
+        def curve_scale(t, covering):
+            scale = 1.0
+            for times, values in covering:
+                if not times[0] <= t <= times[-1]:
+                    continue
+                i = bisect.bisect_right(times, t)-1
+                if i >= len(times)-1 or times[i+1] == times[i]:
+                    scale *= values[i]
+                else:
+                    scale *= values[i]+(values[i+1]-values[i])*(t-times[i])/(times[i+1]-times[i])
+            return scale
+
+        for p in self._merged_pattern():
+            if "Event" not in p or not p["Event"]["EventType"].startswith("Haptic"):
+                continue
+            event = p["Event"]
+            intensity = min(max(event_parameter(event, ParamID.H_Intensity, 0.0), 0.0), 1.0)
+            tone = sharpness_to_freq(min(max(event_parameter(event, ParamID.H_Sharpness, 0.5), 0.0), 1.0))
+            start = int(event["Time"]*sample_rate)
+            if event["EventType"] == "HapticTransient":
+                length = int(CLICK_LENGTH*sample_rate)
+                for i in range(length):
+                    samples[start+i] += intensity*(1-i/length)*math.sin(2*math.pi*tone*i/sample_rate+math.pi/2)
+            else:
+                end = event["Time"]+event["EventDuration"]
+                covering = [(times, values) for times, values in intensity_curves if times[0] <= end and times[-1] >= event["Time"]]
+                for i in range(int(event["EventDuration"]*sample_rate)):
+                    t = event["Time"]+i/sample_rate
+                    samples[start+i] += intensity*curve_scale(t, covering)*math.sin(2*math.pi*tone*i/sample_rate)
+        frames = array.array("h", (int(min(max(v, -1.0), 1.0)*32767) for v in samples))
+        if sys.byteorder == "big":
+            frames.byteswap()
+        with wave.open(os.path.join(path, filename), 'wb') as f:
+            f.setnchannels(1)
+            f.setsampwidth(2)
+            f.setframerate(sample_rate)
+            f.writeframes(frames.tobytes())
+
+    def export_by_channel(self, prefix: str, path: str = ".", **kwargs) -> List[str]:
+        """
+        Export one AHAP file per channel set with set_channel, named prefix_ch0.ahap, prefix_ch1.ahap and so on.
+        Entries that weren't added through the add_* methods belong to channel 0.
+
+        Args:
+            prefix (str): The start of the file names.
+            path (str): The path to the output directory.
+            **kwargs: Extra arguments passed on to json.dumps(), like in export().
+
+        Returns:
+            List[str]: The names of the written files.
+        """
+        self._close_until_next()
+        patterns = {}
+        for p in self._merged_pattern():
+            patterns.setdefault(_channel(p), []).append(_untagged(p))
+        filenames = []
+        for channel in sorted(patterns):
+            filename = f"{prefix}_ch{channel}.ahap"
+            with open(os.path.join(path, filename), 'w') as f:
+                f.write(json.dumps(dict(self.data, Pattern=patterns[channel]), **kwargs))
+            filenames.append(filename)
+        return filenames
+
+    def export_csv(self, f: IO[str], delimiter: str = ","):
+        """
+        Write the pattern as a CSV (or TSV with delimiter="\\t") table, in the column order of CSV_COLUMNS.
+        Every event is one row with its time, type, intensity, sharpness and duration.
+        Every curve control point is one row of type ParameterCurve with the absolute time of the point,
+        the curve's number in curve_id, its parameter and the value. from_csv skips those rows and the audio events.
+
+        Args:
+            f (IO[str]): An open text file to write to. Open it with newline="".
+            delimiter (str): The column separator.
+        """
+        self._close_until_next()
+        writer = csv.writer(f, delimiter=delimiter)
+        writer.writerow(CSV_COLUMNS)
+        curve_id = 0
+        for p in self._merged_pattern():
+            if "Event" in p:
+                event = p["Event"]
+                params = {i["ParameterID"]: i["ParameterValue"] for i in event["EventParameters"]}
+                writer.writerow([event["Time"], event["EventType"], params.get(ParamID.H_Intensity.value, ""),
+                                 params.get(ParamID.H_Sharpness.value, ""), event.get("EventDuration", ""), "", "", ""])
+            elif "ParameterCurve" in p:
+                curve = p["ParameterCurve"]
+                for point in curve["ParameterCurveControlPoints"]:
+                    writer.writerow([curve["Time"]+point["Time"], "ParameterCurve", "", "", "", curve_id, curve["ParameterID"], point["ParameterValue"]])
+                curve_id += 1
+
+    def export_plist(self, filename: str, path: str = "."):
+        """
+        Export the AHAP object to an XML property list that CHHapticPattern(dictionary:) can load directly.
+        The keys are the same as in the JSON file; floats are written as <real> and integers as <integer>.
+
+        Args:
+            filename (str): The name of the output file.
+            path (str): The path to the output directory.
+        """
+        self._close_until_next()
+        with open(os.path.join(path, filename), 'wb') as f:
+            plistlib.dump(self._export_data(), f, sort_keys=False)
+
+    def __call__(self, *args: Any, **kwds: Any) -> Any:
+        self.export(*args, **kwds)
+
+    def __add__(self, other: 'AHAP'):
+        """adds 2 ahap files. Attension, it smooshes them one on another, it doesn't work as expected now. Please don't use this method if you don't want to really smoosh them.
+
+        Args:
+            other (AHAP): another Ahap class.
+        """
+        data = {
+            "Version": 1.0,
+            "Metadata": {
+                "Project": "Basis",
+                "Created": str(_clock()),
+                "Description": self.data["Metadata"]["Description"],
+                "Created By": self.data["Metadata"]["Created By"]
+            },
+            "Pattern": self.data["Pattern"]+other.data["Pattern"]
+        }
+
+def freq(n: int, normalize: bool=True) -> float:
+    """
+    calculates the haptic sharpness value from frequency in hz.
+
+    Args:
+        n (int): The input frequency value.
+        normalize (bool): if normalizing, all high frequencies will be 230 and all low will be 80 if value is too high or too low.
+    Returns:
+        float: The normalized frequency value between 0 and 1.
+
+    Raises:
+        ValueError: If the input frequency is less than 80 or greater than 230.
         ValueError: If the calculated normalized frequency is less than 0 or greater than 1.
     """
     if normalize and n>230: n=230
@@ -281,4 +1966,356 @@ def freq(n: int, normalize: bool=True) -> float:
     r = (math.log(n) - math.log(80)) / (math.log(230) - math.log(80))
     if r < 0 or r > 1:
         raise ValueError("The calculated normalized frequency is out of range. Result must be between 0 and 1.")
-    return r
\ No newline at end of file
+    return r
+
+def sharpness_to_freq(sharpness: float) -> float:
+    """
+    calculates the frequency in hz from haptic sharpness. It's the inverse of freq().
+
+    Args:
+        sharpness (float): The haptic sharpness between 0 and 1.
+    Returns:
+        float: The frequency between 80 and 230 hz.
+
+    Raises:
+        ValueError: If the sharpness is less than 0 or greater than 1.
+    """
+    if sharpness < 0 or sharpness > 1:
+        raise ValueError(f"Incorrect sharpness. Sharpness must be between 0 and 1, but it is {sharpness}")
+    return 80*(230/80)**sharpness
+
+# frequency to sharpness mappings by name, see register_sharpness_model. "log" is the mapping of freq().
+_SHARPNESS_MODELS = {"log": freq}
+
+def register_sharpness_model(name: str, table: List[Tuple[float, float]]):
+    """
+    Registers a mapping from frequency to sharpness for a device, measured as a table of (frequency, sharpness) points.
+    Frequencies between the points are interpolated linearly, frequencies outside of the table get the sharpness of the nearest end.
+
+    Args:
+        name (str): The name of the model, for freq_to_sharpness_model. An existing model of the same name is replaced.
+        table (List[Tuple[float, float]]): At least 2 (frequency in hz, sharpness between 0 and 1) points.
+
+    Raises:
+        ValueError: If the table has less than 2 points, a sharpness out of range or the same frequency twice.
+    """
+    points = sorted(table)
+    if len(points) < 2:
+        raise ValueError(f"A sharpness model needs at least 2 points, but {name} has {len(points)}")
+    if any(s < 0 or s > 1 for f, s in points):
+        raise ValueError(f"The sharpness in the sharpness model {name} must be between 0 and 1")
+    if any(f0 == f1 for (f0, s0), (f1, s1) in zip(points, points[1:])):
+        raise ValueError(f"The sharpness model {name} has the same frequency more than once")
+
+    def model(frequency):
+        if frequency <= points[0][0]:
+            return points[0][1]
+        for (f0, s0), (f1, s1) in zip(points, points[1:]):
+            if frequency <= f1:
+                return s0+(s1-s0)*(frequency-f0)/(f1-f0)
+        return points[-1][1]
+    _SHARPNESS_MODELS[name] = model
+
+def unregister_sharpness_model(name: str):
+    """
+    Removes a model registered with register_sharpness_model. Unknown names are ignored.
+
+    Args:
+        name (str): The name of the model.
+    """
+    _SHARPNESS_MODELS.pop(name, None)
+
+def freq_to_sharpness_model(name: str, frequency: float) -> float:
+    """
+    calculates the haptic sharpness from frequency in hz with a named model, see register_sharpness_model.
+
+    Args:
+        name (str): The name of the model, "log" for the mapping of freq().
+        frequency (float): The frequency in hz.
+    Returns:
+        float: The sharpness between 0 and 1.
+
+    Raises:
+        ValueError: If there is no model with that name.
+    """
+    if name not in _SHARPNESS_MODELS:
+        raise ValueError(f"Unknown sharpness model {name}. Known models are: {', '.join(sorted(_SHARPNESS_MODELS))}")
+    return _SHARPNESS_MODELS[name](frequency)
+
+def grain_cloud(start: float, duration: float, density: float, intensity_range: Tuple[float, float] = (0.0, 1.0),
+                sharpness_range: Tuple[float, float] = (0.0, 1.0), seed: int = None) -> List[dict]:
+    """
+    Scatters random haptic transients over a span of time, for textures like an engine, rain or static.
+    Like the 300 transients of makeahap.py, but with random timing and parameters.
+
+    Args:
+        start (float): The start of the cloud in seconds.
+        duration (float): The length of the cloud in seconds.
+        density (float): The average number of transients per second.
+        intensity_range (Tuple[float, float]): The lowest and highest intensity.
+        sharpness_range (Tuple[float, float]): The lowest and highest sharpness.
+        seed (int): The random seed. The same seed always gives the same cloud.
+
+    Returns:
+        List[dict]: Pattern entries sorted by time, to be added with AHAP.add_events.
+    """
+    rng = random.Random(seed)
+    times = sorted(start+rng.random()*duration for i in range(round(density*duration)))
+    return [{"Event": {
+        "Time": t,
+        "EventType": "HapticTransient",
+        "EventParameters": [
+            {"ParameterID": ParamID.H_Intensity.value, "ParameterValue": rng.uniform(*intensity_range)},
+            {"ParameterID": ParamID.H_Sharpness.value, "ParameterValue": rng.uniform(*sharpness_range)},
+        ]
+    }} for t in times]
+
+def describe_entry(entry: dict) -> str:
+    """
+    Describe a pattern entry in one line, like "HapticTransient at 0.5: HapticIntensity=1, HapticSharpness=0.3".
+
+    Args:
+        entry (dict): An entry of the pattern.
+
+    Returns:
+        str: The description.
+    """
+    kind, value = next(iter(entry.items()))
+    if kind == "Event":
+        text = f"{value['EventType']} at {value['Time']:g}"
+        if "EventDuration" in value:
+            text += f" for {value['EventDuration']:g}"
+        params = [f"{p['ParameterID']}={p['ParameterValue']:g}" for p in value["EventParameters"]]
+        return text+(": "+", ".join(params) if params else "")
+    if kind == "ParameterCurve":
+        return f"{value['ParameterID']} curve at {value['Time']:g} with {len(value['ParameterCurveControlPoints'])} points"
+    return f"{value['ParameterID']} set to {value['ParameterValue']:g} at {value['Time']:g}"
+
+def diff(a: 'AHAP', b: 'AHAP', epsilon: float = 1e-6) -> str:
+    """
+    Compares the patterns of two AHAP objects entry by entry, for reviewing what a change to a generator did.
+    Entries are matched by kind and time, so inserting or removing one doesn't mark every later entry as changed.
+    Lines start with - for entries only in a, + for entries only in b and ~ for entries whose values differ by more than epsilon.
+
+    Args:
+        a (AHAP): The old AHAP.
+        b (AHAP): The new AHAP.
+        epsilon (float): The tolerance for comparing numbers.
+
+    Returns:
+        str: One line per difference, empty if the patterns are the same.
+    """
+    def changes(old, new, path=""):
+        if isinstance(old, (int, float)) and isinstance(new, (int, float)) and not isinstance(old, bool):
+            return [] if abs(old-new) <= epsilon else [f"{path} {old:g} -> {new:g}"]
+        if isinstance(old, dict) and isinstance(new, dict):
+            if "ParameterID" in old and old.get("ParameterID") == new.get("ParameterID") and "ParameterValue" in old and "Time" not in old:
+                return changes(old["ParameterValue"], new.get("ParameterValue"), f"{path}.{old['ParameterID']}".lstrip("."))
+            return [c for key in sorted(set(old) | set(new)) for c in changes(old.get(key), new.get(key), f"{path}.{key}".lstrip("."))]
+        if isinstance(old, list) and isinstance(new, list) and len(old) == len(new):
+            return [c for i, (o, n) in enumerate(zip(old, new)) for c in changes(o, n, f"{path}[{i}]")]
+        return [] if old == new else [f"{path} {old!r} -> {new!r}"]
+
+    def key(p):
+        kind, entry = next(iter(p.items()))
+        return kind, entry.get("EventType", entry.get("ParameterID")), round(entry["Time"]/epsilon) if epsilon > 0 else entry["Time"]
+
+    def compare(i, j):
+        if key(old[i])[:2] == key(new[j])[:2] and abs(next(iter(old[i].values()))["Time"]-next(iter(new[j].values()))["Time"]) <= epsilon:
+            changed = changes(next(iter(old[i].values())), next(iter(new[j].values())))
+            if changed:
+                lines.append(f"~ [{i}] {describe_entry(old[i])}: {'; '.join(changed)}")
+        else:
+            lines.append(f"- [{i}] {describe_entry(old[i])}")
+            lines.append(f"+ [{j}] {describe_entry(new[j])}")
+
+    lines = []
+    old, new = a.data["Pattern"], b.data["Pattern"]
+    matcher = difflib.SequenceMatcher(None, [key(p) for p in old], [key(p) for p in new], autojunk=False)
+    for tag, i1, i2, j1, j2 in matcher.get_opcodes():
+        paired = min(i2-i1, j2-j1) if tag in ("equal", "replace") else 0
+        for n in range(paired):
+            compare(i1+n, j1+n)
+        lines += [f"- [{i}] {describe_entry(old[i])}" for i in range(i1+paired, i2)]
+        lines += [f"+ [{j}] {describe_entry(new[j])}" for j in range(j1+paired, j2)]
+    return "\n".join(lines)
+
+class NoteScheduler:
+    """Keeps track of sounding MIDI notes, to turn note-on and note-off messages into events with a start time and a duration."""
+    def __init__(self):
+        self.pending = {}
+
+    def note_on(self, channel: int, key: int, time: float, velocity: int):
+        """
+        Starts a note.
+
+        Args:
+            channel (int): The MIDI channel.
+            key (int): The MIDI note number.
+            time (float): The time of the note-on in seconds.
+            velocity (int): The velocity of the note-on.
+        """
+        self.pending.setdefault((channel, key), []).append((time, velocity))
+
+    def note_off(self, channel: int, key: int, time: float):
+        """
+        Ends a note. If the same key was started more than once on the channel, the oldest one ends first.
+
+        Args:
+            channel (int): The MIDI channel.
+            key (int): The MIDI note number.
+            time (float): The time of the note-off in seconds.
+
+        Returns:
+            Tuple[float, int]: The start time and velocity of the note, or None if the note wasn't started.
+        """
+        notes = self.pending.get((channel, key))
+        if not notes:
+            return None
+        start = notes.pop(0)
+        if not notes:
+            del self.pending[(channel, key)]
+        return start
+
+EVENT_TYPES = ("AudioContinuous", "AudioCustom", "HapticTransient", "HapticContinuous")
+
+def validate_schema(data) -> None:
+    """
+    Checks that a JSON document has the structure of an AHAP file: required keys, value types and known event types and parameter IDs.
+    It's stricter than playing the file, use it for files from untrusted sources.
+
+    Args:
+        data (str or bytes): The JSON document.
+
+    Raises:
+        ValueError: At the first violation. The message starts with its JSON path, like $.Pattern[2].Event.Time.
+    """
+    def number(value, path):
+        if isinstance(value, bool) or not isinstance(value, (int, float)):
+            raise ValueError(f"{path}: expected a number, got {value!r}")
+
+    def obj(value, path, required, optional=()):
+        if not isinstance(value, dict):
+            raise ValueError(f"{path}: expected an object")
+        for key in required:
+            if key not in value:
+                raise ValueError(f"{path}: missing required key {key}")
+        for key in value:
+            if key not in required and key not in optional:
+                raise ValueError(f"{path}: unknown key {key}")
+
+    def array(value, path):
+        if not isinstance(value, list):
+            raise ValueError(f"{path}: expected an array")
+        return value
+
+    def one_of(value, allowed, path):
+        if value not in allowed:
+            raise ValueError(f"{path}: {value!r} is not one of {', '.join(allowed)}")
+
+    try:
+        doc = json.loads(data)
+    except ValueError as e:
+        raise ValueError(f"$: invalid JSON: {e}") from e
+    obj(doc, "$", ("Version", "Pattern"), ("Metadata",))
+    number(doc["Version"], "$.Version")
+    if "Metadata" in doc and not isinstance(doc["Metadata"], dict):
+        raise ValueError("$.Metadata: expected an object")
+    for key in ("LoopStart", "LoopEnd"):
+        if key in doc.get("Metadata", {}):
+            number(doc["Metadata"][key], "$.Metadata."+key)
+    param_ids = [i.value for i in ParamID]
+    control_ids = [i.value for i in CurveParamID]
+    for n, entry in enumerate(array(doc["Pattern"], "$.Pattern")):
+        path = f"$.Pattern[{n}]"
+        if not isinstance(entry, dict) or len(entry) != 1 or next(iter(entry)) not in ("Event", "ParameterCurve", "Parameter"):
+            raise ValueError(f"{path}: expected an object with one Event, ParameterCurve or Parameter key")
+        kind, value = next(iter(entry.items()))
+        path += "."+kind
+        if kind == "Event":
+            obj(value, path, ("Time", "EventType", "EventParameters"),
+                ("EventDuration", "EventWaveformPath", "EventWaveformLoopEnabled", "EventWaveformUseVolumeEnvelope"))
+            number(value["Time"], path+".Time")
+            for key in ("EventWaveformLoopEnabled", "EventWaveformUseVolumeEnvelope"):
+                if key in value and not isinstance(value[key], bool):
+                    raise ValueError(f"{path}.{key}: expected true or false, got {value[key]!r}")
+            one_of(value["EventType"], EVENT_TYPES, path+".EventType")
+            if "EventDuration" in value:
+                number(value["EventDuration"], path+".EventDuration")
+            if value["EventType"] == "AudioCustom" and not isinstance(value.get("EventWaveformPath"), str):
+                raise ValueError(f"{path}.EventWaveformPath: AudioCustom events need a waveform path")
+            for i, param in enumerate(array(value["EventParameters"], path+".EventParameters")):
+                param_path = f"{path}.EventParameters[{i}]"
+                obj(param, param_path, ("ParameterID", "ParameterValue"))
+                one_of(param["ParameterID"], param_ids, param_path+".ParameterID")
+                number(param["ParameterValue"], param_path+".ParameterValue")
+        elif kind == "ParameterCurve":
+            obj(value, path, ("ParameterID", "Time", "ParameterCurveControlPoints"))
+            one_of(value["ParameterID"], control_ids, path+".ParameterID")
+            number(value["Time"], path+".Time")
+            for i, point in enumerate(array(value["ParameterCurveControlPoints"], path+".ParameterCurveControlPoints")):
+                point_path = f"{path}.ParameterCurveControlPoints[{i}]"
+                obj(point, point_path, ("Time", "ParameterValue"))
+                number(point["Time"], point_path+".Time")
+                number(point["ParameterValue"], point_path+".ParameterValue")
+        else:
+            obj(value, path, ("ParameterID", "Time", "ParameterValue"))
+            one_of(value["ParameterID"], control_ids, path+".ParameterID")
+            number(value["Time"], path+".Time")
+            number(value["ParameterValue"], path+".ParameterValue")
+
+def db_to_linear(db: float) -> float:
+    """
+    converts a level in decibels (dBFS, 0 or less) to the linear 0 to 1 scale of intensity and volume.
+    For example add_haptic_transient_event(0, db_to_linear(-6)) plays at about half intensity.
+
+    Args:
+        db (float): The level in decibels. 0 dB is full intensity.
+    Returns:
+        float: The linear value, clamped between 0 and 1.
+    """
+    return min(max(10**(db/20), 0.0), 1.0)
+
+def load_library(directory: str) -> dict:
+    """
+    Load every .ahap file of a directory, to use them as motifs with AHAP.insert.
+
+    Args:
+        directory (str): The directory.
+
+    Returns:
+        dict: The loaded AHAP objects, keyed by file name without the .ahap extension.
+    """
+    return {os.path.splitext(name)[0]: AHAP.load(name, directory)
+            for name in sorted(os.listdir(directory)) if name.lower().endswith(".ahap")}
+
+def velocity_to_intensity(velocity: int, curve: str = "linear", floor: float = 0.0) -> float:
+    """
+    converts a MIDI velocity into haptic intensity.
+
+    Args:
+        velocity (int): The MIDI velocity, 0 to 127.
+        curve (str): The shape of the mapping: "linear", "log" (boosts soft notes) or "exp:<k>" (k > 0 softens quiet notes, k < 0 boosts them).
+        floor (float): The lowest intensity of a sounding note, so quiet notes can still be felt. Velocity 0 always gives 0.
+    Returns:
+        float: The intensity between 0 and 1.
+
+    Raises:
+        ValueError: If the curve isn't recognized.
+    """
+    if velocity <= 0:
+        return 0.0
+    x = min(velocity, 127)/127
+    if curve == "linear":
+        y = x
+    elif curve == "log":
+        y = math.log10(1+9*x)
+    elif curve.startswith("exp:"):
+        try:
+            k = float(curve[4:])
+        except ValueError:
+            raise ValueError(f"Incorrect velocity curve {curve}. The exponent must be a number.")
+        y = x if k == 0 else (math.exp(k*x)-1)/(math.exp(k)-1)
+    else:
+        raise ValueError(f"Incorrect velocity curve {curve}. It must be linear, log or exp:<k>.")
+    return floor+(1-floor)*y
@@ -1,5 +1,5 @@
 from librosa import midi_to_hz as note
-from ahap import AHAP, freq
+from ahap import AHAP, NoteScheduler, freq
 import mido
 import sys
 
@@ -18,20 +18,22 @@ ahap = AHAP(f"midi file {filename}", "midi to haptic generator")
 
 
 # Step 3: Convert notes to haptics
-note_state = {}  # Dictionary to track note states (on/off)
+notes = NoteScheduler()  # tracks the sounding notes per channel and key
 for msg in midi_file:
     time += msg.time
     if msg.is_meta and hasattr(msg, "note"): continue
     if msg.type == 'note_on' and msg.velocity>0:
-        note_state[msg.note] = time
+        notes.note_on(msg.channel, msg.note, time, msg.velocity)
     elif msg.type == 'note_off' or (msg.type=='note_on' and msg.velocity==0):  # musescore doesn't do note_off, it does note on with velocity 0.
-        if msg.note not in note_state:
+        started = notes.note_off(msg.channel, msg.note, time)
+        if started is None:
             print(f"Warning: Found note_off message without a corresponding note_on for note {msg.note}")
         else:
-            duration = time - note_state[msg.note]
+            start, velocity = started
+            duration = time - start
             #print(duration)
             # Add a haptic event for the note
-            ahap.add_haptic_continuous_event(note_state[msg.note], duration, 1.0, freq(note(msg.note)))
+            ahap.add_haptic_continuous_event(start, duration, 1.0, freq(note(msg.note)))
 
 
 # Step 4: Export the haptics to an AHAP file
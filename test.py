@@ -1,5 +1,13 @@
+import copy
+import datetime
+import io
+import json
+import os
+import plistlib
+import tempfile
 import unittest
-from ahap import freq
+import wave
+from ahap import AHAP, PRESETS, TRANSIENT_ENERGY, CurveParamID, HapticCurve, NoteScheduler, ParamID, Preset, clamp_parameter, create_curve, curve_from_func, db_to_linear, describe_entry, diff, event_parameter, freq, freq_to_sharpness_model, grain_cloud, keyframe_curve, load_library, log_ramp_curve, parameter_range, pattern_span, ramp_curve, register_sharpness_model, set_clock, sharpness_to_freq, simplify_curve, unregister_sharpness_model, validate_schema, velocity_to_intensity
 
 class TestFreq(unittest.TestCase):
     #def setUp(self) -> None:
@@ -16,5 +24,1199 @@ class TestFreq(unittest.TestCase):
             freq(79, False)
             freq(231, False)
 
+    def test_sharpness_to_freq(self):
+        for i in range(80, 231):
+            self.assertAlmostEqual(sharpness_to_freq(freq(i, False)), i)
+        self.assertEqual(sharpness_to_freq(0), 80)
+        self.assertAlmostEqual(sharpness_to_freq(1), 230)
+
+    def test_raise_sharpness_to_freq(self):
+        with self.assertRaises(ValueError):
+            sharpness_to_freq(-0.1)
+        with self.assertRaises(ValueError):
+            sharpness_to_freq(1.1)
+
+class TestRamp(unittest.TestCase):
+    def test_ramp(self):
+        ahap = AHAP()
+        ahap.add_ramp(1.0, 2.0, 0.2, 0.9, steps=5)
+        event, curve, restore = ahap.data["Pattern"]
+        self.assertEqual(event["Event"]["EventType"], "HapticContinuous")
+        self.assertEqual(event_parameter(event["Event"], ParamID.H_Intensity), 1.0)
+        self.assertEqual(restore["Parameter"], {"ParameterID": "HapticIntensityControl", "Time": 3.0, "ParameterValue": 1.0})
+        self.assertEqual(curve["ParameterCurve"]["ParameterID"], CurveParamID.H_Intensity.value)
+        self.assertEqual(curve["ParameterCurve"]["Time"], event["Event"]["Time"])
+        points = curve["ParameterCurve"]["ParameterCurveControlPoints"]
+        self.assertEqual(len(points), 5)
+        self.assertEqual(points[-1]["Time"], 2.0)
+        self.assertAlmostEqual(points[-1]["ParameterValue"], 0.9)
+
+    def test_sharpness_ramp(self):
+        ahap = AHAP()
+        ahap.add_sharpness_ramp(0.0, 1.0, 0.2, 1.0, steps=3)
+        event, curve, restore = ahap.data["Pattern"]
+        self.assertEqual(event_parameter(event["Event"], ParamID.H_Sharpness), 0.0)
+        self.assertEqual(curve["ParameterCurve"]["ParameterID"], CurveParamID.H_Sharpness.value)
+        self.assertEqual(len(curve["ParameterCurve"]["ParameterCurveControlPoints"]), 3)
+        self.assertEqual(curve["ParameterCurve"]["ParameterCurveControlPoints"][0]["ParameterValue"], 0.2)
+        self.assertEqual(restore["Parameter"], {"ParameterID": "HapticSharpnessControl", "Time": 1.0, "ParameterValue": 0.0})
+
+    def test_ramp_from_zero(self):
+        ahap = AHAP()
+        ahap.add_ramp(0.0, 1.0, 0.0, 1.0)
+        event = ahap.data["Pattern"][0]["Event"]
+        self.assertEqual(event_parameter(event, ParamID.H_Intensity), 1.0)
+        points = ahap.data["Pattern"][1]["ParameterCurve"]["ParameterCurveControlPoints"]
+        self.assertEqual((points[0]["ParameterValue"], points[-1]["ParameterValue"]), (0.0, 1.0))
+
+    def test_log_ramp_curve(self):
+        points = log_ramp_curve(1.0, 0.0, 1.0, 5)
+        values = [p.parameter_value for p in points]
+        self.assertEqual((values[0], values[-1]), (0.0, 1.0))
+        self.assertEqual([p.time for p in points], [0.0, 0.25, 0.5, 0.75, 1.0])
+        self.assertEqual(values, sorted(values))
+        self.assertGreater(values[2], 0.5)
+        steps = [b-a for a, b in zip(values, values[1:])]
+        self.assertEqual(steps, sorted(steps, reverse=True))
+
+    def test_keyframe_curve(self):
+        points = keyframe_curve([(0.0, 0.0), (1.0, 0.5), (3.0, 1.0)], "ease", 5)
+        self.assertEqual(len(points), 9)
+        self.assertEqual([(p.time, p.parameter_value) for p in points[::4]], [(0.0, 0.0), (1.0, 0.5), (3.0, 1.0)])
+        times = [p.time for p in points]
+        values = [p.parameter_value for p in points]
+        self.assertEqual(times, sorted(set(times)))
+        self.assertEqual(values, sorted(values))
+        self.assertLess(values[1], 0.125)
+        with self.assertRaises(ValueError):
+            keyframe_curve([(0.0, 0.0), (1.0, 1.0)], "bounce")
+
+class TestCurveOverruns(unittest.TestCase):
+    def test_overrun_reported(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(1.0, 1.0)
+        ahap.add_parameter_curve(CurveParamID.H_Sharpness, 1.0, create_curve(0.0, 1.5, 0.0, 1.0))
+        ahap.add_ramp(3.0, 1.0, 0.0, 1.0)
+        overruns = ahap.check_curve_overruns()
+        self.assertEqual(len(overruns), 1)
+        index, overshoot = overruns[0]
+        self.assertEqual(index, 1)
+        self.assertAlmostEqual(overshoot, 0.5)
+
+class TestAudioCustom(unittest.TestCase):
+    def test_parameters(self):
+        ahap = AHAP()
+        ahap.add_audio_custom_event(0.5, "click.wav", volume=0.6, pitch=0.2, pan=-0.5)
+        event = json.loads(json.dumps(ahap.data))["Pattern"][0]["Event"]
+        self.assertEqual(event["EventType"], "AudioCustom")
+        self.assertEqual(event["EventWaveformPath"], "click.wav")
+        params = {p["ParameterID"]: p["ParameterValue"] for p in event["EventParameters"]}
+        self.assertEqual(params, {"AudioVolume": 0.6, "AudioPitch": 0.2, "AudioPan": -0.5})
+
+    def test_path_checks(self):
+        ahap = AHAP()
+        with self.assertRaises(ValueError):
+            ahap.add_audio_custom_event(0.0, "")
+        with self.assertWarns(UserWarning):
+            ahap.add_audio_custom_event(0.0, "missing.wav", check_exists=True)
+
+    def test_loop(self):
+        ahap = AHAP()
+        ahap.add_audio_custom_event(0.0, "rain.wav", loop_enabled=True)
+        ahap.add_audio_custom_event(1.0, "click.wav")
+        looping, plain = [p["Event"] for p in json.loads(json.dumps(ahap.data))["Pattern"]]
+        self.assertIs(looping["EventWaveformLoopEnabled"], True)
+        self.assertNotIn("EventWaveformUseVolumeEnvelope", looping)
+        self.assertNotIn("EventWaveformLoopEnabled", plain)
+        validate_schema(json.dumps(ahap.data))
+
+class TestPlist(unittest.TestCase):
+    def test_roundtrip(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.3)
+        ahap.add_ramp(0.5, 1.0, 0.0, 1.0, steps=3)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export_plist("test.plist", d)
+            with open(os.path.join(d, "test.plist"), "rb") as f:
+                data = plistlib.load(f)
+        self.assertEqual(data, ahap.data)
+        self.assertIsInstance(data["Version"], float)
+
+class TestCSV(unittest.TestCase):
+    def test_import(self):
+        ahap = AHAP.from_csv(io.StringIO("time,type,intensity,sharpness,duration,note\n"
+                                         "0.0,transient,1.0,0.2,,kick\n"
+                                         "0.5,continuous,0.7,,2.0,pad\n"))
+        transient, continuous = [p["Event"] for p in ahap.data["Pattern"]]
+        self.assertEqual(transient["EventType"], "HapticTransient")
+        self.assertEqual(transient["EventParameters"][1]["ParameterValue"], 0.2)
+        self.assertEqual(continuous["EventType"], "HapticContinuous")
+        self.assertEqual(continuous["EventDuration"], 2.0)
+        self.assertEqual(continuous["EventParameters"][1]["ParameterValue"], 0.5)
+
+    def test_bad_row(self):
+        with self.assertRaisesRegex(ValueError, "line 3"):
+            AHAP.from_csv(io.StringIO("time,type\n0.0,transient\nsoon,transient\n"))
+
+    def test_export_roundtrip(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.2)
+        ahap.add_ramp(0.5, 2.0, 0.1, 0.9, 0.4, steps=4)
+        f = io.StringIO(newline="")
+        ahap.export_csv(f)
+        lines = f.getvalue().splitlines()
+        self.assertEqual(lines[0], "time,type,intensity,sharpness,duration,curve_id,parameter,value")
+        self.assertEqual(len(lines), 1+2+4)
+        f.seek(0)
+        events = [p for p in ahap.data["Pattern"] if "Event" in p]
+        self.assertEqual(AHAP.from_csv(f).data["Pattern"], events)
+
+    def test_roundtrip_with_audio(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.2)
+        ahap.add_audio_custom_event(0.0, "a.wav")
+        ahap.add_audio_continuous_event(0.5, 1.0)
+        ahap.add_haptic_continuous_event(1.0, 2.0, 0.6, 0.4)
+        f = io.StringIO(newline="")
+        ahap.export_csv(f)
+        f.seek(0)
+        haptic = [p for p in ahap.data["Pattern"] if p["Event"]["EventType"].startswith("Haptic")]
+        self.assertEqual(AHAP.from_csv(f).data["Pattern"], haptic)
+
+class TestLimitDensity(unittest.TestCase):
+    def test_keeps_strongest(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 1.0)
+        intensities = [0.1, 0.5, 0.9, 0.2, 0.3, 1.0, 0.4, 0.15, 0.8, 0.25]
+        for i, intensity in enumerate(intensities):
+            ahap.add_haptic_transient_event(i*0.01, intensity)
+        self.assertEqual(ahap.limit_density(0.1, 3), 7)
+        self.assertEqual(ahap.data["Pattern"][0]["Event"]["EventType"], "HapticContinuous")
+        kept = [p["Event"]["EventParameters"][0]["ParameterValue"] for p in ahap.data["Pattern"][1:]]
+        self.assertEqual(kept, [0.9, 1.0, 0.8])
+
+class TestADSR(unittest.TestCase):
+    def test_curve(self):
+        ahap = AHAP()
+        ahap.add_continuous_adsr(1.0, 2.0, 0.9, 0.6, 0.5, 0.1, 0.2, 0.5)
+        event, curve, restore = ahap.data["Pattern"]
+        self.assertEqual(event["Event"]["EventDuration"], 2.0)
+        self.assertEqual(event_parameter(event["Event"], ParamID.H_Intensity), 1.0)
+        points = curve["ParameterCurve"]["ParameterCurveControlPoints"]
+        self.assertEqual(points[1], {"Time": 0.1, "ParameterValue": 0.9})
+        self.assertEqual(points[-1]["Time"], 2.0)
+        self.assertEqual(points[-1]["ParameterValue"], 0.0)
+        self.assertEqual(restore["Parameter"], {"ParameterID": "HapticIntensityControl", "Time": 3.0, "ParameterValue": 1.0})
+
+    def test_too_long(self):
+        with self.assertRaises(ValueError):
+            AHAP().add_continuous_adsr(0.0, 1.0, 1.0, 0.5, 0.5, 0.5, 0.3, 0.3)
+
+class TestPanSweep(unittest.TestCase):
+    def test_full_sweep(self):
+        ahap = AHAP()
+        ahap.add_pan_sweep(0.0, 2.0, -1.0, 1.0, steps=5)
+        curve = ahap.data["Pattern"][0]["ParameterCurve"]
+        self.assertEqual(curve["ParameterID"], CurveParamID.A_Pan.value)
+        values = [p["ParameterValue"] for p in curve["ParameterCurveControlPoints"]]
+        self.assertEqual(values, [-1.0, -0.5, 0.0, 0.5, 1.0])
+
+class TestParameterRange(unittest.TestCase):
+    def test_ranges(self):
+        self.assertEqual(parameter_range(ParamID.H_Intensity), (0.0, 1.0))
+        self.assertEqual(parameter_range("AudioPan"), (-1.0, 1.0))
+        self.assertEqual(parameter_range(CurveParamID.A_Pitch), (-1.0, 1.0))
+
+    def test_pan_not_clamped_to_unit(self):
+        self.assertEqual(clamp_parameter(ParamID.A_Pan, -0.8), -0.8)
+        self.assertEqual(clamp_parameter(ParamID.A_Pan, -2.0), -1.0)
+        self.assertEqual(clamp_parameter(ParamID.H_Intensity, -0.8), 0.0)
+
+class TestOverlappingContinuous(unittest.TestCase):
+    def setUp(self):
+        self.ahap = AHAP()
+        self.ahap.add_haptic_continuous_event(0.0, 1.0, 0.4, 0.2)
+        self.ahap.add_haptic_transient_event(0.5)
+        self.ahap.add_haptic_continuous_event(2.0, 1.0, 0.2, 0.2)
+        self.ahap.add_haptic_continuous_event(2.5, 3.0, 0.6, 0.6)
+
+    def test_reported(self):
+        self.assertEqual(self.ahap.overlapping_continuous(), [(2, 3)])
+
+    def test_merge(self):
+        self.assertEqual(self.ahap.merge_overlapping_continuous(), 1)
+        self.assertEqual(self.ahap.overlapping_continuous(), [])
+        merged = self.ahap.data["Pattern"][2]["Event"]
+        self.assertEqual(merged["Time"], 2.0)
+        self.assertEqual(merged["EventDuration"], 3.5)
+        self.assertAlmostEqual(event_parameter(merged, ParamID.H_Intensity), 0.5)
+
+class TestVelocityToIntensity(unittest.TestCase):
+    def test_linear(self):
+        self.assertAlmostEqual(velocity_to_intensity(1), 1/127)
+        self.assertAlmostEqual(velocity_to_intensity(64), 64/127)
+        self.assertEqual(velocity_to_intensity(127), 1.0)
+
+    def test_log(self):
+        self.assertGreater(velocity_to_intensity(1, "log"), 1/127)
+        self.assertGreater(velocity_to_intensity(64, "log"), 64/127)
+        self.assertAlmostEqual(velocity_to_intensity(127, "log"), 1.0)
+
+    def test_exp(self):
+        self.assertLess(velocity_to_intensity(1, "exp:3"), 1/127)
+        self.assertLess(velocity_to_intensity(64, "exp:3"), 64/127)
+        self.assertAlmostEqual(velocity_to_intensity(127, "exp:3"), 1.0)
+
+    def test_floor(self):
+        self.assertEqual(velocity_to_intensity(0, floor=0.2), 0.0)
+        self.assertGreaterEqual(velocity_to_intensity(1, floor=0.2), 0.2)
+        with self.assertRaises(ValueError):
+            velocity_to_intensity(64, "cubic")
+
+class TestComments(unittest.TestCase):
+    def test_roundtrip(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_comment(0.0, "intro")
+        ahap.add_comment(4.0, "chorus")
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("test.ahap", d)
+            with open(os.path.join(d, "test.ahap")) as f:
+                data = json.load(f)
+        self.assertEqual(data["Metadata"]["Comments"], [{"Time": 0.0, "Text": "intro"}, {"Time": 4.0, "Text": "chorus"}])
+        self.assertEqual(len(data["Pattern"]), 1)
+
+class TestTranspose(unittest.TestCase):
+    def test_octave_up(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, freq(100))
+        ahap.add_haptic_continuous_event(0.5, 1.0, 1.0, freq(200))
+        ahap.transpose_sharpness(12)
+        transient, continuous = [p["Event"] for p in ahap.data["Pattern"]]
+        self.assertAlmostEqual(sharpness_to_freq(event_parameter(transient, ParamID.H_Sharpness)), 200)
+        self.assertEqual(event_parameter(continuous, ParamID.H_Sharpness), 1.0)
+
+    def test_roundtrip(self):
+        for f in (80, 110, 150.5, 230):
+            self.assertAlmostEqual(sharpness_to_freq(freq(f)), f)
+
+class TestTimeOffset(unittest.TestCase):
+    def test_sections(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.5)
+        ahap.set_time_offset(10.0)
+        ahap.add_ramp(0.0, 1.0, 0.0, 1.0)
+        ahap.set_time_offset(0.0)
+        ahap.add_haptic_transient_event(1.0)
+        times = [next(iter(p.values()))["Time"] for p in ahap.data["Pattern"]]
+        self.assertEqual(times, [0.5, 10.0, 10.0, 11.0, 1.0])
+
+    def test_markers(self):
+        ahap = AHAP()
+        ahap.set_time_offset(10.0)
+        ahap.add_comment(0.5, "chorus")
+        ahap.set_loop(0.0, 2.0)
+        self.assertEqual(ahap.data["Metadata"]["Comments"], [{"Time": 10.5, "Text": "chorus"}])
+        self.assertEqual(ahap.loop(), (10.0, 12.0))
+
+    def test_group(self):
+        def motif(a):
+            for t in (0.0, 0.1, 0.2):
+                a.add_haptic_transient_event(t)
+
+        ahap = AHAP()
+        ahap.set_time_offset(1.0)
+        ahap.group(4.0, motif)
+        ahap.add_haptic_transient_event(0.0)
+        times = [p["Event"]["Time"] for p in ahap.data["Pattern"]]
+        self.assertEqual([round(t, 6) for t in times], [5.0, 5.1, 5.2, 1.0])
+
+    def test_repeat_with_variation(self):
+        def bar(a, rep, rng):
+            a.add_haptic_transient_event(0.0, 1.0)
+            a.add_haptic_transient_event(0.5, rng.uniform(0.3, 0.6))
+            if rep == 3:
+                a.add_haptic_transient_event(0.75)
+
+        ahap = AHAP()
+        ahap.repeat_with_variation(4, 1.0, bar, seed=5)
+        times = [p["Event"]["Time"] for p in ahap.data["Pattern"]]
+        self.assertEqual(times, [0.0, 0.5, 1.0, 1.5, 2.0, 2.5, 3.0, 3.5, 3.75])
+        again = AHAP()
+        again.repeat_with_variation(4, 1.0, bar, seed=5)
+        self.assertEqual(again.data["Pattern"], ahap.data["Pattern"])
+
+class TestCurveFromFunc(unittest.TestCase):
+    def test_square(self):
+        points = curve_from_func(0.0, 1.0, 11, lambda t: t*t)
+        values = [p.parameter_value for p in points]
+        self.assertEqual(len(points), 11)
+        self.assertTrue(all(a < b for a, b in zip(values, values[1:])))
+        self.assertAlmostEqual(points[5].parameter_value, 0.25)
+
+    def test_clamped(self):
+        points = curve_from_func(0.0, 1.0, 3, lambda t: 4*t-2, CurveParamID.A_Pan)
+        self.assertEqual([p.parameter_value for p in points], [-1.0, 0.0, 1.0])
+
+class TestAppend(unittest.TestCase):
+    def test_append(self):
+        intro = AHAP()
+        intro.add_haptic_continuous_event(0.5, 1.5)
+        outro = AHAP()
+        outro.add_haptic_transient_event(0.0)
+        self.assertEqual(intro.duration(), 2.0)
+        intro.append(outro)
+        self.assertEqual(intro.data["Pattern"][1]["Event"]["Time"], 2.0)
+        self.assertEqual(outro.data["Pattern"][0]["Event"]["Time"], 0.0)
+
+class TestFade(unittest.TestCase):
+    def test_fade_in(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0)
+        ahap.add_haptic_transient_event(0.5, 1.0)
+        ahap.add_haptic_continuous_event(0.0, 3.0, 1.0)
+        ahap.fade_in(1.0)
+        # the curve fades the transients too, so their own intensity must stay as it was.
+        self.assertEqual(event_parameter(ahap.data["Pattern"][0]["Event"], ParamID.H_Intensity), 1.0)
+        self.assertEqual(event_parameter(ahap.data["Pattern"][1]["Event"], ParamID.H_Intensity), 1.0)
+        self.assertEqual(len(ahap.data["Pattern"]), 4)
+        curve = ahap.data["Pattern"][3]["ParameterCurve"]
+        self.assertEqual(curve["Time"], 0.0)
+        self.assertEqual(curve["ParameterCurveControlPoints"], [{"Time": 0.0, "ParameterValue": 0.0}, {"Time": 1.0, "ParameterValue": 1.0}])
+
+    def test_fade_in_transients(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0)
+        ahap.add_haptic_transient_event(0.5, 1.0)
+        ahap.add_haptic_transient_event(2.0, 1.0)
+        ahap.fade_in(1.0)
+        intensities = [event_parameter(p["Event"], ParamID.H_Intensity) for p in ahap.data["Pattern"]]
+        self.assertEqual(intensities, [0.0, 0.5, 1.0])
+
+    def test_one_curve(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 1.0)
+        ahap.add_haptic_continuous_event(0.2, 1.0)
+        ahap.fade_in(0.5)
+        self.assertEqual(sum("ParameterCurve" in p for p in ahap.data["Pattern"]), 1)
+
+    def test_fade_out(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(1.0, 3.0, 1.0)
+        ahap.fade_out(2.0)
+        curve = ahap.data["Pattern"][1]["ParameterCurve"]
+        self.assertEqual(curve["Time"], 2.0)
+        self.assertEqual([(p["Time"], p["ParameterValue"]) for p in curve["ParameterCurveControlPoints"]], [(0.0, 1.0), (2.0, 0.0)])
+
+class TestClamp(unittest.TestCase):
+    def test_clamp(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.5, 0.5)
+        ahap.add_audio_custom_event(0.0, "a.wav", pan=-0.8)
+        ahap.add_pan_sweep(0.0, 1.0, -2.0, 1.0, steps=2)
+        self.assertEqual(ahap.clamp(), 2)
+        self.assertEqual(event_parameter(ahap.data["Pattern"][0]["Event"], ParamID.H_Intensity), 1.0)
+        self.assertEqual(event_parameter(ahap.data["Pattern"][1]["Event"], ParamID.A_Pan), -0.8)
+        self.assertEqual(ahap.data["Pattern"][2]["ParameterCurve"]["ParameterCurveControlPoints"][0]["ParameterValue"], -1.0)
+        self.assertEqual(ahap.clamp(), 0)
+
+class TestDynamicParameter(unittest.TestCase):
+    def test_json(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 4.0)
+        ahap.add_dynamic_parameter(CurveParamID.H_Intensity, 2.0, 0.5)
+        entry = json.loads(json.dumps(ahap.data))["Pattern"][1]
+        self.assertEqual(entry, {"Parameter": {"ParameterID": "HapticIntensityControl", "Time": 2.0, "ParameterValue": 0.5}})
+
+    def test_scale_from(self):
+        ahap = AHAP()
+        ahap.scale_from(2.0, CurveParamID.H_Sharpness, -0.3)
+        ahap.scale_from(3.0, ParamID.H_Intensity, 0.5)
+        control, event_param = [p["Parameter"] for p in ahap.data["Pattern"]]
+        self.assertEqual(control["ParameterID"], "HapticSharpnessControl")
+        self.assertEqual(event_param["ParameterID"], "HapticIntensityControl")
+        self.assertEqual(event_param["ParameterValue"], 0.5)
+
+class TestPresets(unittest.TestCase):
+    def test_heartbeat(self):
+        ahap = AHAP()
+        ahap.add_preset(1.0, Preset.Heartbeat)
+        events = [p["Event"] for p in ahap.data["Pattern"]]
+        self.assertEqual([e["EventType"] for e in events], ["HapticTransient"]*2)
+        self.assertAlmostEqual(events[1]["Time"]-events[0]["Time"], 0.15)
+        self.assertEqual(events[0]["Time"], 1.0)
+
+    def test_all_presets(self):
+        for preset in Preset:
+            ahap = AHAP()
+            ahap.add_preset(0.0, preset)
+            self.assertEqual(len(ahap.data["Pattern"]), len(PRESETS[preset]))
+
+class TestTrim(unittest.TestCase):
+    def setUp(self):
+        self.ahap = AHAP()
+        self.ahap.add_haptic_transient_event(0.5)
+        self.ahap.add_haptic_continuous_event(1.0, 2.0)
+        self.ahap.add_haptic_transient_event(4.0)
+
+    def test_trim_before(self):
+        self.ahap.trim_before(2.0)
+        continuous, transient = [p["Event"] for p in self.ahap.data["Pattern"]]
+        self.assertEqual((continuous["Time"], continuous["EventDuration"]), (2.0, 1.0))
+        self.assertEqual(transient["Time"], 4.0)
+
+    def test_trim_after(self):
+        self.ahap.trim_after(1.5)
+        transient, continuous = [p["Event"] for p in self.ahap.data["Pattern"]]
+        self.assertEqual(transient["Time"], 0.5)
+        self.assertEqual((continuous["Time"], continuous["EventDuration"]), (1.0, 0.5))
+
+    def test_trim_silence(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(1.5)
+        ahap.add_haptic_continuous_event(2.0, 1.0)
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 2.5, ramp_curve(0.5, 1.0, 0.0))
+        self.assertEqual(ahap.trim_silence(), 1.5)
+        times = [next(iter(p.values()))["Time"] for p in ahap.data["Pattern"]]
+        self.assertEqual(times, [0.0, 0.5, 1.0])
+        self.assertEqual(ahap.duration(), 1.5)
+
+class TestSlice(unittest.TestCase):
+    def test_slice(self):
+        ahap = AHAP("original")
+        ahap.add_haptic_transient_event(0.5)
+        ahap.add_haptic_continuous_event(1.0, 2.0)
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 1.0, [HapticCurve(0.0, 0.0), HapticCurve(2.0, 1.0)])
+        ahap.add_haptic_transient_event(2.5)
+        ahap.add_haptic_transient_event(3.0)
+        sliced = ahap.slice(2.0, 3.0)
+        self.assertEqual(sliced.data["Metadata"]["Description"], "original")
+        continuous, curve, transient = sliced.data["Pattern"]
+        self.assertEqual((continuous["Event"]["Time"], continuous["Event"]["EventDuration"]), (0.0, 1.0))
+        self.assertEqual(curve["ParameterCurve"]["Time"], 0.0)
+        self.assertEqual(curve["ParameterCurve"]["ParameterCurveControlPoints"],
+                         [{"Time": 0.0, "ParameterValue": 0.5}, {"Time": 1.0, "ParameterValue": 1.0}])
+        self.assertEqual(transient["Event"]["Time"], 0.5)
+        self.assertEqual(len(ahap.data["Pattern"]), 5)
+
+    def test_markers(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 12.0)
+        ahap.add_comment(1.0, "intro")
+        ahap.add_comment(7.0, "hook")
+        ahap.set_loop(6.0, 8.0)
+        sliced = ahap.slice(5.0, 10.0)
+        self.assertEqual(sliced.loop(), (1.0, 3.0))
+        self.assertEqual(sliced.data["Metadata"]["Comments"], [{"Time": 2.0, "Text": "hook"}])
+        self.assertIsNone(ahap.slice(0.0, 5.0).loop())
+        self.assertEqual(ahap.loop(), (6.0, 8.0))
+
+    def test_trim_silence_markers(self):
+        ahap = AHAP()
+        ahap.add_comment(0.5, "silence")
+        ahap.add_comment(2.5, "hit")
+        ahap.set_loop(2.0, 3.0)
+        ahap.add_haptic_transient_event(2.0)
+        ahap.trim_silence()
+        self.assertEqual(ahap.loop(), (0.0, 1.0))
+        self.assertEqual(ahap.data["Metadata"]["Comments"], [{"Time": 0.5, "Text": "hit"}])
+
+class TestVisitors(unittest.TestCase):
+    def test_counts(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_ramp(0.5, 1.0, 0.0, 1.0)
+        ahap.add_pan_sweep(0.5, 1.0, -1.0, 1.0)
+        ahap.add_dynamic_parameter(CurveParamID.H_Intensity, 1.0, 0.5)
+        events, curves = [], []
+        ahap.for_each_event(lambda i, e: events.append(i))
+        ahap.for_each_curve(lambda i, c: curves.append(c["ParameterID"]))
+        self.assertEqual(events, [0, 1])
+        self.assertEqual(curves, ["HapticIntensityControl", "AudioPanControl"])
+
+class TestEventsInRange(unittest.TestCase):
+    def test_membership(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 5.0)
+        ahap.add_haptic_transient_event(1.0)
+        ahap.add_haptic_transient_event(2.0)
+        ahap.add_haptic_transient_event(3.0)
+        ahap.add_haptic_continuous_event(3.0, 1.0)
+        times = [e["Time"] for e in ahap.events_in_range(2.0, 3.0)]
+        self.assertEqual(times, [0.0, 2.0])
+        self.assertEqual(len(ahap.events_in_range(5.0, 6.0)), 0)
+
+class TestDefaults(unittest.TestCase):
+    def test_defaults(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0)
+        ahap.set_defaults(0.8, 0.3)
+        ahap.add_haptic_transient_event(1.0)
+        ahap.add_haptic_continuous_event(2.0, 1.0, haptic_intensity=1.0)
+        values = [(event_parameter(p["Event"], ParamID.H_Intensity), event_parameter(p["Event"], ParamID.H_Sharpness)) for p in ahap.data["Pattern"]]
+        self.assertEqual(values, [(0.5, 0.5), (0.8, 0.3), (1.0, 0.3)])
+
+    def test_continuous_envelope(self):
+        ahap = AHAP()
+        ahap.set_continuous_envelope(0.1, 0.3)
+        ahap.add_haptic_continuous_event(0.0, 1.0)
+        ahap.add_haptic_transient_event(1.0)
+        ahap.clear_continuous_envelope()
+        ahap.add_haptic_continuous_event(2.0, 1.0)
+        enveloped, transient, plain = [p["Event"] for p in ahap.data["Pattern"]]
+        self.assertEqual(event_parameter(enveloped, ParamID.H_AttackTime), 0.1)
+        self.assertEqual(event_parameter(enveloped, ParamID.H_ReleaseTime), 0.3)
+        self.assertEqual(len(transient["EventParameters"]), 2)
+        self.assertEqual(len(plain["EventParameters"]), 2)
+
+    def test_frequency(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, frequency=80)
+        ahap.add_haptic_continuous_event(0.0, 1.0, frequency=230)
+        ahap.add_haptic_transient_event(1.0, frequency=440)
+        sharpness = [event_parameter(p["Event"], ParamID.H_Sharpness) for p in ahap.data["Pattern"]]
+        self.assertEqual(sharpness, [0.0, 1.0, 1.0])
+        with self.assertRaises(ValueError):
+            ahap.add_haptic_transient_event(2.0, frequency=440, normalize=False)
+
+    def test_transient_like(self):
+        ahap = AHAP()
+        ahap.add_transient_like(0.0)
+        ahap.add_haptic_transient_event(1.0, 0.9, 0.1)
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 1.0, ramp_curve(1.0, 0.0, 1.0))
+        ahap.add_transient_like(2.0)
+        values = [(event_parameter(p["Event"], ParamID.H_Intensity), event_parameter(p["Event"], ParamID.H_Sharpness))
+                  for p in ahap.data["Pattern"] if "Event" in p]
+        self.assertEqual(values, [(0.5, 0.5), (0.9, 0.1), (0.9, 0.1)])
+
+class TestContinuousUntilNext(unittest.TestCase):
+    def test_next_event(self):
+        ahap = AHAP()
+        ahap.add_continuous_until_next(0.0)
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_haptic_transient_event(2.0)
+        self.assertEqual(ahap.data["Pattern"][0]["Event"]["EventDuration"], 2.0)
+
+    def test_pattern_end(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 3.0)
+        ahap.add_continuous_until_next(1.0)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("test.ahap", d)
+        self.assertEqual(ahap.data["Pattern"][1]["Event"]["EventDuration"], 2.0)
+
+class TestValidateSchema(unittest.TestCase):
+    def setUp(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_ramp(0.5, 1.0, 0.0, 1.0)
+        ahap.add_audio_custom_event(1.0, "a.wav", pan=0.5)
+        ahap.add_dynamic_parameter(CurveParamID.H_Intensity, 1.0, 0.5)
+        self.data = ahap.data
+
+    def test_valid(self):
+        validate_schema(json.dumps(self.data))
+        with open(os.path.join(os.path.dirname(os.path.abspath(__file__)), "ahaps", "bike.ahap"), "rb") as f:
+            validate_schema(f.read())
+
+    def test_missing_version(self):
+        del self.data["Version"]
+        with self.assertRaisesRegex(ValueError, r"^\$: missing required key Version"):
+            validate_schema(json.dumps(self.data))
+
+    def test_non_numeric_time(self):
+        self.data["Pattern"][1]["Event"]["Time"] = "0.5"
+        with self.assertRaisesRegex(ValueError, r"^\$\.Pattern\[1\]\.Event\.Time:"):
+            validate_schema(json.dumps(self.data))
+
+class TestTimeline(unittest.TestCase):
+    def test_render(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.0)
+        ahap.add_haptic_continuous_event(1.0, 1.0, 0.5, 1.0)
+        lines = ahap.render_timeline(21).splitlines()
+        self.assertEqual([line.split()[0] for line in lines], ["events", "intensity", "sharpness"])
+        events = lines[0][10:]
+        self.assertEqual(len(events), 21)
+        self.assertEqual(events[0], "|")
+        self.assertEqual(events[10:], "="*11)
+        self.assertEqual(lines[1][10], "9")
+
+class TestChannels(unittest.TestCase):
+    def test_export_by_channel(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0)
+        ahap.set_channel(1)
+        ahap.add_haptic_transient_event(0.5)
+        with tempfile.TemporaryDirectory() as d:
+            self.assertEqual(ahap.export_by_channel("drums", d), ["drums_ch0.ahap", "drums_ch1.ahap"])
+            patterns = []
+            for name in ("drums_ch0.ahap", "drums_ch1.ahap"):
+                with open(os.path.join(d, name)) as f:
+                    patterns.append(json.load(f)["Pattern"])
+        self.assertEqual([[p["Event"]["Time"] for p in pattern] for pattern in patterns], [[0.0], [0.5]])
+
+    def test_tags_follow_entries(self):
+        ahap = AHAP()
+        ahap.set_channel(1)
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_haptic_transient_event(0.0)
+        ahap.dedupe_transients()
+        ahap.data = {"Version": 1.0, "Metadata": {}, "Pattern": [{"Event": {"Time": float(t), "EventType": "HapticTransient", "EventParameters": []}} for t in range(100)]}
+        with tempfile.TemporaryDirectory() as d:
+            self.assertEqual(ahap.export_by_channel("drums", d), ["drums_ch0.ahap"])
+
+    def test_tags_not_exported(self):
+        ahap = AHAP()
+        ahap.set_channel(2)
+        ahap.add_haptic_transient_event(0.0)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("tagged.ahap", d)
+            ahap.export_by_channel("tagged", d)
+            for name in ("tagged.ahap", "tagged_ch2.ahap"):
+                with open(os.path.join(d, name)) as f:
+                    validate_schema(f.read())
+
+class TestCreated(unittest.TestCase):
+    def build(self, **kwargs):
+        ahap = AHAP(**kwargs)
+        ahap.add_haptic_transient_event(0.0)
+        return json.dumps(ahap.data)
+
+    def test_fixed_created(self):
+        created = datetime.datetime(2024, 1, 2, 3, 4, 5)
+        self.assertEqual(self.build(created=created), self.build(created=created))
+        self.assertIn("2024-01-02 03:04:05", self.build(created=created))
+
+    def test_clock(self):
+        set_clock(lambda: datetime.datetime(2024, 1, 2))
+        try:
+            self.assertEqual(self.build(), self.build())
+        finally:
+            set_clock()
+        self.assertNotIn("2024-01-02", self.build())
+
+    def test_project_and_version(self):
+        ahap = AHAP(project="Racing game", version=2.0)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("test.ahap", d)
+            with open(os.path.join(d, "test.ahap")) as f:
+                data = json.load(f)
+        self.assertEqual(data["Version"], 2.0)
+        self.assertEqual(data["Metadata"]["Project"], "Racing game")
+        self.assertEqual(AHAP().data["Metadata"]["Project"], "Basis")
+
+class TestGrainCloud(unittest.TestCase):
+    def test_cloud(self):
+        grains = grain_cloud(2.0, 4.0, 50, (0.2, 0.4), (0.5, 1.0), seed=1)
+        self.assertAlmostEqual(len(grains), 200, delta=10)
+        for g in grains:
+            self.assertTrue(2.0 <= g["Event"]["Time"] <= 6.0)
+            self.assertTrue(0.2 <= event_parameter(g["Event"], ParamID.H_Intensity) <= 0.4)
+        self.assertEqual(grains, grain_cloud(2.0, 4.0, 50, (0.2, 0.4), (0.5, 1.0), seed=1))
+
+    def test_add_events(self):
+        grains = grain_cloud(0.0, 1.0, 3, seed=2)
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 1.0)
+        ahap.add_events(*grains)
+        self.assertEqual(len(ahap.data["Pattern"]), 4)
+        self.assertEqual(ahap.data["Pattern"][1:], grains)
+        self.assertIsNot(ahap.data["Pattern"][1], grains[0])
+
+class TestEnergy(unittest.TestCase):
+    def test_estimate(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 2.0, 0.5)
+        self.assertAlmostEqual(ahap.energy_estimate(), 1.0)
+        ahap.add_haptic_transient_event(3.0, 1.0)
+        self.assertAlmostEqual(ahap.energy_estimate(), 1.0+TRANSIENT_ENERGY)
+
+class TestLegacyKeys(unittest.TestCase):
+    def test_legacy_export(self):
+        ahap = AHAP(created_by="me")
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("legacy.ahap", d, legacy_keys=True)
+            ahap.export("modern.ahap", d)
+            with open(os.path.join(d, "legacy.ahap")) as f:
+                legacy = json.load(f)
+            with open(os.path.join(d, "modern.ahap")) as f:
+                modern = json.load(f)
+        self.assertEqual(legacy["Metadata"]["CreatedBy"], "me")
+        self.assertNotIn("Created By", legacy["Metadata"])
+        self.assertEqual(modern["Metadata"]["Created By"], "me")
+        self.assertEqual(ahap.data["Metadata"]["Created By"], "me")
+
+class TestValidate(unittest.TestCase):
+    def test_zero_duration(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 1.0)
+        self.assertEqual(ahap.validate(), [])
+        ahap.add_haptic_continuous_event(1.0, 0.0)
+        problems = ahap.validate()
+        self.assertEqual(len(problems), 1)
+        self.assertIn("Pattern[1]", problems[0])
+
+class TestHeartbeat(unittest.TestCase):
+    def test_60_bpm(self):
+        ahap = AHAP()
+        ahap.add_heartbeat(1.0, 60, 3, 0.8)
+        events = [p["Event"] for p in ahap.data["Pattern"]]
+        times = [e["Time"] for e in events]
+        self.assertEqual(len(events), 6)
+        for i in range(3):
+            self.assertAlmostEqual(times[2*i], 1.0+i)
+            self.assertAlmostEqual(times[2*i+1]-times[2*i], 0.12)
+        self.assertLess(event_parameter(events[1], ParamID.H_Intensity), event_parameter(events[0], ParamID.H_Intensity))
+
+class TestPreviewWAV(unittest.TestCase):
+    def test_one_transient(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.5)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export_preview_wav("preview.wav", d, 8000)
+            with open(os.path.join(d, "preview.wav"), "rb") as f:
+                self.assertEqual(f.read(4), b"RIFF")
+            with wave.open(os.path.join(d, "preview.wav"), "rb") as f:
+                self.assertEqual((f.getnchannels(), f.getsampwidth(), f.getframerate()), (1, 2, 8000))
+                frames = f.readframes(f.getnframes())
+        self.assertNotEqual(frames[:2], b"\x00\x00")
+
+class TestTracks(unittest.TestCase):
+    def test_tracks(self):
+        ahap = AHAP("song")
+        ahap.track("drums").add_haptic_transient_event(0.0)
+        ahap.track("drums").add_haptic_transient_event(0.5)
+        ahap.track("bass").add_haptic_continuous_event(0.0, 1.0)
+        with tempfile.TemporaryDirectory() as d:
+            self.assertEqual(ahap.export_tracks(d), ["drums.ahap", "bass.ahap"])
+            ahap.export("song.ahap", d)
+            counts = {}
+            for name in ("drums.ahap", "bass.ahap", "song.ahap"):
+                with open(os.path.join(d, name)) as f:
+                    counts[name] = len(json.load(f)["Pattern"])
+        self.assertEqual(counts, {"drums.ahap": 2, "bass.ahap": 1, "song.ahap": 3})
+        self.assertEqual(ahap.data["Pattern"], [])
+
+    def test_comments_not_shared(self):
+        ahap = AHAP("song")
+        ahap.add_comment(0.0, "intro")
+        ahap.track("drums").add_comment(1.0, "fill")
+        self.assertEqual(len(ahap.data["Metadata"]["Comments"]), 1)
+        self.assertEqual(len(ahap.track("drums").data["Metadata"]["Comments"]), 2)
+
+    def test_tracks_count_everywhere(self):
+        ahap = AHAP("song")
+        ahap.track("drums").add_haptic_transient_event(2.0)
+        self.assertEqual(ahap.duration(), 2.0)
+        self.assertEqual(ahap.stats()["events"], {"HapticTransient": 1})
+        f = io.StringIO(newline="")
+        ahap.export_csv(f)
+        self.assertEqual(len(f.getvalue().splitlines()), 2)
+        with tempfile.TemporaryDirectory() as d:
+            self.assertEqual(ahap.export_by_channel("song", d), ["song_ch0.ahap"])
+            ahap.export_preview_wav("song.wav", d, 8000)
+            with wave.open(os.path.join(d, "song.wav")) as w:
+                self.assertGreater(w.getnframes(), 2*8000)
+
+    def test_finalize_tracks(self):
+        ahap = AHAP("song")
+        ahap.add_haptic_transient_event(1.0, 0.5)
+        ahap.track("drums").add_haptic_transient_event(1.0, 1.0)
+        ahap.track("drums").add_event("HapticTransient", 0.5, [{"ParameterID": "HapticIntensity", "ParameterValue": 1.5}])
+        ahap.finalize()
+        self.assertEqual(ahap.data["Pattern"], [])
+        drums = ahap.track("drums").data["Pattern"]
+        self.assertEqual([p["Event"]["Time"] for p in drums], [0.5, 1.0])
+        self.assertEqual(event_parameter(drums[0]["Event"], ParamID.H_Intensity), 1.0)
+        ahap.track("bass").add_event("HapticContinuous", 0.0, [], 0.0)
+        with self.assertRaises(ValueError):
+            ahap.finalize()
+        self.assertAlmostEqual(ahap.energy_estimate(), 2*TRANSIENT_ENERGY)
+
+class TestLimits(unittest.TestCase):
+    def test_density(self):
+        ahap = AHAP()
+        for i in range(300):
+            ahap.add_haptic_transient_event(i*0.05, 1.0, 1.0)
+        warnings = ahap.check_limits()
+        self.assertEqual(len(warnings), 1)
+        self.assertIn("20 transients within one second", warnings[0])
+        self.assertEqual(ahap.check_limits(max_density=20), [])
+
+    def test_events_and_duration(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 40.0)
+        ahap.add_haptic_transient_event(1.0)
+        self.assertEqual(len(ahap.check_limits(max_events=1)), 2)
+
+class TestDecibels(unittest.TestCase):
+    def test_db_to_linear(self):
+        self.assertEqual(db_to_linear(0), 1.0)
+        self.assertAlmostEqual(db_to_linear(-6), 0.5, places=2)
+        self.assertAlmostEqual(db_to_linear(-20), 0.1)
+        self.assertEqual(db_to_linear(6), 1.0)
+
+class TestCurveFor(unittest.TestCase):
+    def test_curve_for(self):
+        ahap = AHAP()
+        ahap.set_time_offset(2.0)
+        ahap.add_haptic_transient_event(0.0)
+        ahap.add_haptic_continuous_event(1.5, 1.0)
+        ahap.add_curve_for(1, CurveParamID.H_Sharpness, ramp_curve(1.0, 0.0, 1.0))
+        self.assertEqual(ahap.data["Pattern"][2]["ParameterCurve"]["Time"], 3.5)
+        with self.assertRaises(ValueError):
+            ahap.add_curve_for(0, CurveParamID.H_Sharpness, ramp_curve(1.0, 0.0, 1.0))
+        with self.assertRaises(ValueError):
+            ahap.add_curve_for(5, CurveParamID.H_Sharpness, ramp_curve(1.0, 0.0, 1.0))
+
+class TestDiff(unittest.TestCase):
+    def test_one_change(self):
+        a = AHAP()
+        a.add_haptic_transient_event(0.0, 0.5, 0.5)
+        a.add_ramp(1.0, 1.0, 0.0, 1.0)
+        b = copy.deepcopy(a)
+        b.data["Pattern"][0]["Event"]["EventParameters"][0]["ParameterValue"] = 0.8
+        b.data["Pattern"][1]["Event"]["Time"] += 1e-9
+        lines = diff(a, b).splitlines()
+        self.assertEqual(lines, ["~ [0] HapticTransient at 0: HapticIntensity=0.5, HapticSharpness=0.5: EventParameters[0].HapticIntensity 0.5 -> 0.8"])
+        self.assertEqual(diff(a, a), "")
+
+    def test_added_and_removed(self):
+        a = AHAP()
+        a.add_haptic_transient_event(0.0)
+        b = AHAP()
+        self.assertEqual(diff(a, b), "- [0] HapticTransient at 0: HapticIntensity=0.5, HapticSharpness=0.5")
+        self.assertTrue(diff(b, a).startswith("+ [0]"))
+
+    def test_insertion(self):
+        a = AHAP()
+        for t in (1.0, 2.0, 3.0):
+            a.add_haptic_transient_event(t)
+        b = copy.deepcopy(a)
+        b.data["Pattern"].insert(0, copy.deepcopy(b.data["Pattern"][0]))
+        b.data["Pattern"][0]["Event"]["Time"] = 0.0
+        self.assertEqual(diff(a, b), "+ [0] HapticTransient at 0: HapticIntensity=0.5, HapticSharpness=0.5")
+        self.assertEqual(diff(b, a), "- [0] HapticTransient at 0: HapticIntensity=0.5, HapticSharpness=0.5")
+
+class TestAudioCurve(unittest.TestCase):
+    def test_volume_fade_out(self):
+        ahap = AHAP()
+        ahap.add_audio_continuous_event(0.0, 2.0, 0.8, pan=-0.5)
+        ahap.add_audio_curve(CurveParamID.A_Volume, 0.0, ramp_curve(2.0, 1.0, 0.0, steps=3))
+        event, curve = ahap.data["Pattern"]
+        self.assertEqual(event["Event"]["EventType"], "AudioContinuous")
+        self.assertEqual(event_parameter(event["Event"], ParamID.A_Pan), -0.5)
+        self.assertEqual(curve["ParameterCurve"]["ParameterID"], "AudioVolumeControl")
+        self.assertEqual(curve["ParameterCurve"]["ParameterCurveControlPoints"],
+                         [{"Time": 0.0, "ParameterValue": 1.0}, {"Time": 1.0, "ParameterValue": 0.5}, {"Time": 2.0, "ParameterValue": 0.0}])
+
+    def test_ranges(self):
+        ahap = AHAP()
+        ahap.add_audio_curve(CurveParamID.A_Pitch, 0.0, [HapticCurve(0.0, -0.8), HapticCurve(1.0, -3.0)])
+        values = [p["ParameterValue"] for p in ahap.data["Pattern"][0]["ParameterCurve"]["ParameterCurveControlPoints"]]
+        self.assertEqual(values, [-0.8, -1.0])
+        with self.assertRaises(ValueError):
+            ahap.add_audio_curve(CurveParamID.H_Intensity, 0.0, [])
+
+class TestTransients(unittest.TestCase):
+    def test_spacing(self):
+        ahap = AHAP()
+        ahap.add_haptic_transients(1.0, 0.05, 5, 0.9, 0.1)
+        times = [p["Event"]["Time"] for p in ahap.data["Pattern"]]
+        self.assertEqual(len(times), 5)
+        for i, t in enumerate(times):
+            self.assertAlmostEqual(t, 1.0+i*0.05)
+        self.assertEqual(event_parameter(ahap.data["Pattern"][4]["Event"], ParamID.H_Intensity), 0.9)
+
+class TestExport(unittest.TestCase):
+    def test_grid(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.12345)
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 0.30049, [HapticCurve(0.0101, 1.0)])
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("grid.ahap", d, grid=0.001)
+            with open(os.path.join(d, "grid.ahap")) as f:
+                data = json.load(f)
+        self.assertEqual(data["Pattern"][0]["Event"]["Time"], 0.123)
+        self.assertEqual(data["Pattern"][1]["ParameterCurve"]["Time"], 0.3)
+        self.assertEqual(data["Pattern"][1]["ParameterCurve"]["ParameterCurveControlPoints"][0]["Time"], 0.01)
+        self.assertEqual(ahap.data["Pattern"][0]["Event"]["Time"], 0.12345)
+
+    def test_compact_curves(self):
+        ahap = AHAP()
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 0.0, ramp_curve(1.0, 0.0, 1.0, 19))
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("standard.ahap", d, indent=4)
+            ahap.export("compact.ahap", d, compact_curves=True, indent=4)
+            with open(os.path.join(d, "standard.ahap")) as f:
+                standard = f.read()
+            with open(os.path.join(d, "compact.ahap")) as f:
+                compact = f.read()
+        self.assertEqual(json.loads(compact), json.loads(standard))
+        self.assertLess(compact.count("\n")*5, standard.count("\n"))
+
+    def test_compact_curves_placeholder_text(self):
+        ahap = AHAP("@curve0@")
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 0.0, ramp_curve(1.0, 0.0, 1.0, 3))
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("compact.ahap", d, compact_curves=True)
+            with open(os.path.join(d, "compact.ahap")) as f:
+                data = json.load(f)
+        self.assertEqual(data["Metadata"]["Description"], "@curve0@")
+        self.assertEqual(len(data["Pattern"][0]["ParameterCurve"]["ParameterCurveControlPoints"]), 3)
+
+class TestStats(unittest.TestCase):
+    def test_stats(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.0, 1.0, 0.2)
+        ahap.add_haptic_transient_event(1.0, 0.5, 0.4)
+        ahap.add_ramp(2.0, 2.0, 0.0, 1.0, 0.6)
+        ahap.add_audio_custom_event(0.0, "a.wav")
+        stats = ahap.stats()
+        self.assertEqual(stats["events"], {"HapticTransient": 2, "HapticContinuous": 1, "AudioCustom": 1})
+        self.assertEqual(stats["curves"], {"HapticIntensityControl": 1})
+        self.assertEqual(stats["duration"], 4.0)
+        self.assertEqual(stats["transient_density"], 0.5)
+        self.assertEqual(stats["intensity"]["max"], 1.0)
+        self.assertEqual(stats["intensity"]["min"], 0.5)
+        self.assertAlmostEqual(stats["sharpness"]["mean"], 0.4)
+        self.assertIsNone(AHAP().stats()["intensity"])
+
+class TestLibrary(unittest.TestCase):
+    def test_load_and_insert(self):
+        with tempfile.TemporaryDirectory() as d:
+            tap = AHAP()
+            tap.add_haptic_transient_event(0.0, 1.0)
+            tap.add_haptic_transient_event(0.1, 0.5)
+            tap.export("tap.ahap", d)
+            AHAP().export("empty.ahap", d)
+            with open(os.path.join(d, "notes.txt"), "w") as f:
+                f.write("not a pattern")
+            library = load_library(d)
+        self.assertEqual(sorted(library), ["empty", "tap"])
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 2.0)
+        ahap.insert(1.0, library["tap"])
+        self.assertEqual([p["Event"]["Time"] for p in ahap.data["Pattern"]], [0.0, 1.0, 1.1])
+        self.assertEqual(library["tap"].data["Pattern"][1]["Event"]["Time"], 0.1)
+
+    def test_insert_looping_motif(self):
+        motif = AHAP()
+        motif.add_audio_custom_event(0.0, "rain.wav", loop_enabled=True, use_volume_envelope=False)
+        ahap = AHAP()
+        ahap.insert(2.0, motif)
+        event = ahap.data["Pattern"][0]["Event"]
+        self.assertEqual(event["Time"], 2.0)
+        self.assertIs(event["EventWaveformLoopEnabled"], True)
+        self.assertIs(event["EventWaveformUseVolumeEnvelope"], False)
+
+class TestNoteScheduler(unittest.TestCase):
+    def test_overlapping(self):
+        notes = NoteScheduler()
+        notes.note_on(0, 60, 0.0, 100)
+        notes.note_on(0, 60, 0.5, 80)
+        self.assertEqual(notes.note_off(0, 60, 1.0), (0.0, 100))
+        self.assertEqual(notes.note_off(0, 60, 1.5), (0.5, 80))
+        self.assertIsNone(notes.note_off(0, 60, 2.0))
+
+    def test_cross_channel(self):
+        notes = NoteScheduler()
+        notes.note_on(0, 60, 0.0, 100)
+        notes.note_on(9, 60, 0.25, 50)
+        self.assertEqual(notes.note_off(9, 60, 0.5), (0.25, 50))
+        self.assertIsNone(notes.note_off(9, 60, 0.6))
+        self.assertEqual(notes.note_off(0, 60, 1.0), (0.0, 100))
+
+class TestFinalize(unittest.TestCase):
+    def test_messy(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(2.0, 1.0, 1.5, 0.5, normalize=False)
+        ahap.add_haptic_transient_event(1.0, 0.3)
+        ahap.add_haptic_transient_event(1.0, 0.8)
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 0.5, ramp_curve(1.0, -0.5, 2.0))
+        ahap.finalize()
+        pattern = ahap.data["Pattern"]
+        self.assertEqual([pattern_span(p)[0] for p in pattern], [0.5, 1.0, 2.0])
+        self.assertEqual(event_parameter(pattern[1]["Event"], ParamID.H_Intensity), 0.8)
+        self.assertEqual(event_parameter(pattern[2]["Event"], ParamID.H_Intensity), 1.0)
+        self.assertEqual(ahap.clamp(), 0)
+
+    def test_invalid(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(1.0, 0.0)
+        with self.assertRaises(ValueError):
+            ahap.finalize()
+
+    def test_dedupe_across_rounding(self):
+        ahap = AHAP()
+        ahap.add_haptic_transient_event(0.49e-6, 0.3)
+        ahap.add_haptic_transient_event(0.51e-6, 0.8)
+        ahap.add_haptic_transient_event(1.0, 0.5)
+        self.assertEqual(ahap.dedupe_transients(), 1)
+        self.assertEqual([event_parameter(p["Event"], ParamID.H_Intensity) for p in ahap.data["Pattern"]], [0.8, 0.5])
+
+class TestStr(unittest.TestCase):
+    def test_summary(self):
+        ahap = AHAP("debug")
+        ahap.add_haptic_transient_event(0.25, 1.0, 0.5)
+        ahap.add_haptic_continuous_event(1.0, 2.0)
+        text = str(ahap)
+        self.assertIn("2 events", text)
+        self.assertIn("HapticTransient at 0.25", text)
+        self.assertEqual(len(text.splitlines()), 3)
+        self.assertEqual(repr(ahap), repr(ahap.data))
+
+class TestPitchMelody(unittest.TestCase):
+    def test_three_notes(self):
+        ahap = AHAP()
+        ahap.add_pitch_melody(1.0, [60, 67, 84], 0.5, glide=0.1)
+        event, curve = ahap.data["Pattern"]
+        self.assertEqual((event["Event"]["EventType"], event["Event"]["EventDuration"]), ("AudioContinuous", 1.5))
+        self.assertEqual(curve["ParameterCurve"]["ParameterID"], "AudioPitchControl")
+        self.assertEqual(curve["ParameterCurve"]["Time"], 1.0)
+        points = [(round(p["Time"], 9), round(p["ParameterValue"], 9)) for p in curve["ParameterCurve"]["ParameterCurveControlPoints"]]
+        self.assertEqual(points, [(0.0, 0.0), (0.4, 0.0), (0.5, 0.583333333), (0.9, 0.583333333), (1.0, 1.0), (1.5, 1.0)])
+
+    def test_glide_too_long(self):
+        with self.assertRaises(ValueError):
+            AHAP().add_pitch_melody(0.0, [60, 62], 0.1, glide=0.2)
+
+class TestSimplify(unittest.TestCase):
+    def test_straight_line(self):
+        line = [HapticCurve(i*0.1, i/49) for i in range(50)]
+        simplified = simplify_curve(line, 0.001)
+        self.assertEqual([(p.time, p.parameter_value) for p in simplified], [(0.0, 0.0), (4.9, 1.0)])
+
+    def test_keeps_corners(self):
+        peak = [HapticCurve(0.0, 0.0), HapticCurve(0.5, 0.5), HapticCurve(1.0, 1.0), HapticCurve(1.5, 0.5), HapticCurve(2.0, 0.0)]
+        self.assertEqual([p.time for p in simplify_curve(peak, 0.01)], [0.0, 1.0, 2.0])
+
+    def test_simplify_curves(self):
+        ahap = AHAP()
+        ahap.add_parameter_curve(CurveParamID.H_Intensity, 0.0, [HapticCurve(i*0.1, i/49) for i in range(50)])
+        self.assertEqual(ahap.simplify_curves(0.001), 48)
+        self.assertEqual(len(ahap.data["Pattern"][0]["ParameterCurve"]["ParameterCurveControlPoints"]), 2)
+
+    def test_curve_tolerance(self):
+        ahap = AHAP()
+        ahap.add_ramp(0.0, 1.0, 0.0, 1.0, steps=50)
+        ahap.set_curve_tolerance(0.001)
+        ahap.add_ramp(2.0, 1.0, 0.0, 1.0, steps=50)
+        ahap.set_curve_tolerance(None)
+        ahap.add_ramp(4.0, 1.0, 0.0, 1.0, steps=50)
+        counts = [len(p["ParameterCurve"]["ParameterCurveControlPoints"]) for p in ahap.data["Pattern"] if "ParameterCurve" in p]
+        self.assertEqual(counts, [50, 2, 50])
+
+    def test_curve_tolerance_everywhere(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 5.0)
+        ahap.set_curve_tolerance(0.001)
+        ahap.add_curve_for(0, CurveParamID.H_Sharpness, [HapticCurve(i*0.1, i/49) for i in range(50)])
+        self.assertEqual(len(ahap.data["Pattern"][1]["ParameterCurve"]["ParameterCurveControlPoints"]), 2)
+
+    def test_curve_tolerance_add_events(self):
+        source = AHAP()
+        source.add_parameter_curve(CurveParamID.H_Intensity, 0.5, ramp_curve(1.0, 0.0, 1.0, 50))
+        ahap = AHAP()
+        ahap.set_channel(2)
+        ahap.set_time_offset(1.0)
+        ahap.set_curve_tolerance(0.001)
+        ahap.add_events(*source.data["Pattern"])
+        curve = ahap.data["Pattern"][0]
+        self.assertEqual(len(curve["ParameterCurve"]["ParameterCurveControlPoints"]), 2)
+        self.assertEqual(curve["ParameterCurve"]["Time"], 1.5)
+        with tempfile.TemporaryDirectory() as d:
+            self.assertEqual(ahap.export_by_channel("curve", d), ["curve_ch2.ahap"])
+        self.assertEqual(len(source.data["Pattern"][0]["ParameterCurve"]["ParameterCurveControlPoints"]), 50)
+
+class TestSoftTransient(unittest.TestCase):
+    def test_soft_transient(self):
+        ahap = AHAP()
+        ahap.add_soft_transient(1.0, 0.8, 0.4, 0.03)
+        transient, continuous, curve, restore = ahap.data["Pattern"]
+        self.assertEqual(transient["Event"]["EventType"], "HapticTransient")
+        self.assertEqual((continuous["Event"]["EventType"], continuous["Event"]["Time"], continuous["Event"]["EventDuration"]), ("HapticContinuous", 1.0, 0.03))
+        self.assertEqual(event_parameter(continuous["Event"], ParamID.H_Intensity), 0.8)
+        self.assertEqual(curve["ParameterCurve"]["ParameterID"], "HapticIntensityControl")
+        self.assertEqual([(p["Time"], p["ParameterValue"]) for p in curve["ParameterCurve"]["ParameterCurveControlPoints"]], [(0.0, 1.0), (0.03, 0.0)])
+        self.assertEqual(restore["Parameter"], {"ParameterID": "HapticIntensityControl", "Time": 1.03, "ParameterValue": 1.0})
+
+class TestSharpnessModel(unittest.TestCase):
+    def test_custom_model(self):
+        register_sharpness_model("test device", [(200, 1.0), (100, 0.2)])
+        self.addCleanup(unregister_sharpness_model, "test device")
+        self.assertAlmostEqual(freq_to_sharpness_model("test device", 150), 0.6)
+        self.assertEqual(freq_to_sharpness_model("test device", 50), 0.2)
+        self.assertEqual(freq_to_sharpness_model("test device", 300), 1.0)
+
+    def test_log_model(self):
+        self.assertEqual(freq_to_sharpness_model("log", 150), freq(150))
+
+    def test_errors(self):
+        with self.assertRaises(ValueError):
+            freq_to_sharpness_model("no such device", 100)
+        register_sharpness_model("removed device", [(100, 0.0), (200, 1.0)])
+        unregister_sharpness_model("removed device")
+        with self.assertRaises(ValueError):
+            freq_to_sharpness_model("removed device", 100)
+        with self.assertRaises(ValueError):
+            register_sharpness_model("one point", [(100, 0.5)])
+        with self.assertRaises(ValueError):
+            register_sharpness_model("too sharp", [(100, 0.5), (200, 1.5)])
+
+class TestLoop(unittest.TestCase):
+    def test_round_trip(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 4.0)
+        self.assertIsNone(ahap.loop())
+        ahap.set_loop(1.0, 3.5)
+        with tempfile.TemporaryDirectory() as d:
+            ahap.export("loop.ahap", d)
+            loaded = AHAP.load("loop.ahap", d)
+            with open(os.path.join(d, "loop.ahap")) as f:
+                validate_schema(f.read())
+        self.assertEqual(loaded.loop(), (1.0, 3.5))
+
+    def test_invalid(self):
+        with self.assertRaises(ValueError):
+            AHAP().set_loop(2.0, 1.0)
+
+class TestAutoRelease(unittest.TestCase):
+    def test_single_event(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(1.0, 2.0)
+        self.assertEqual(ahap.auto_release(0.25), 1)
+        curve = ahap.data["Pattern"][1]["ParameterCurve"]
+        self.assertEqual((curve["ParameterID"], curve["Time"]), ("HapticIntensityControl", 2.75))
+        self.assertEqual(pattern_span(ahap.data["Pattern"][1])[1], 3.0)
+        self.assertEqual(curve["ParameterCurveControlPoints"][-1]["ParameterValue"], 0.0)
+        self.assertEqual(ahap.data["Pattern"][2]["Parameter"], {"ParameterID": "HapticIntensityControl", "Time": 3.0, "ParameterValue": 1.0})
+        self.assertEqual(ahap.auto_release(0.25), 0)
+        self.assertEqual(len(ahap.data["Pattern"]), 3)
+
+    def test_short_event(self):
+        ahap = AHAP()
+        ahap.add_haptic_continuous_event(0.0, 0.1)
+        ahap.auto_release(0.25)
+        self.assertEqual(ahap.data["Pattern"][1]["ParameterCurve"]["Time"], 0.0)
+
+class TestVersion(unittest.TestCase):
+    def test_version_2(self):
+        with tempfile.TemporaryDirectory() as d:
+            with open(os.path.join(d, "v2.ahap"), "w") as f:
+                json.dump({"Version": 2.0, "Pattern": []}, f)
+            with self.assertWarns(UserWarning):
+                ahap = AHAP.load("v2.ahap", d)
+        self.assertEqual(ahap.data["Version"], 2.0)
+        self.assertFalse(ahap.supported_version())
+        self.assertEqual(len(ahap.validate()), 1)
+        self.assertIn("Version 2.0", ahap.validate()[0])
+
+    def test_version_1(self):
+        ahap = AHAP()
+        self.assertTrue(ahap.supported_version())
+        self.assertEqual(ahap.validate(), [])
+
 if __name__=="__main__":
     unittest.main()
\ No newline at end of file